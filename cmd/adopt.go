@@ -0,0 +1,298 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// bucket configuration key accepting a bucket which already exists
+	// and is owned by the storage class's account as the new bucket
+	cfgAdoptExisting = "adoptExisting"
+	// bucket tag holding the time the bucket was adopted
+	tagAdopted = tagPrefix + "adopted"
+)
+
+// getAdoptConfig validates and sets the adoption setting of cfg.
+func getAdoptConfig(cfg *bucketConfig, params map[string]string, obc *v1alpha1.ObjectBucketClaim) error {
+
+	switch v := configValue(params, obc, cfgAdoptExisting); v {
+	case "yes":
+		cfg.adoptExisting = true
+	case "", "no":
+	default:
+		return fmt.Errorf("invalid %s %q, must be \"yes\" or \"no\"", cfgAdoptExisting, v)
+	}
+	return nil
+}
+
+// adoptBucket checks an existing bucket of the account can be taken over
+// for the claim and returns its tags to keep, with the adoption recorded.
+// Buckets provisioned by the operator for another claim or cluster, in
+// another location, or lacking object lock when it's required, aren't
+// adopted.
+func (p *awsS3Provisioner) adoptBucket(bktName string, options *apibkt.BucketOptions) (map[string]string, error) {
+
+	tags, err := p.getBucketTags(bktName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+	obc := options.ObjectBucketClaim
+	if id, ok := tags[tagClusterID]; ok {
+		if !p.ownedByCluster(tags) {
+			return nil, fmt.Errorf("bucket %q belongs to cluster %q and provisioner %q, it can't be adopted",
+				bktName, id, tags[tagProvisioner])
+		}
+		if uid := tags[tagOBCUID]; uid != "" && uid != string(obc.UID) {
+			return nil, fmt.Errorf("bucket %q belongs to claim \"%s/%s\", it can't be adopted",
+				bktName, tags[tagOBCNamespace], tags[tagOBCName])
+		}
+	}
+
+	err = p.checkBucketLocation(bktName, options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.bktConfig.objectLock {
+		_, err = p.s3svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: aws.String(bktName)})
+		if isAWSErrorCode(err, errNoObjectLockConfig) {
+			return nil, fmt.Errorf("bucket %q doesn't have object lock enabled, it can't be adopted", bktName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting object lock configuration of bucket %q: %v", bktName, err)
+		}
+	}
+
+	// keep the bucket's own tags, replacing any left by the operator
+	kept := map[string]string{}
+	for k, v := range tags {
+		if !strings.HasPrefix(k, tagPrefix) {
+			kept[k] = v
+		}
+	}
+	for k, v := range p.bktUserTags {
+		kept[k] = v
+	}
+	if adopted, ok := tags[tagAdopted]; ok {
+		kept[tagAdopted] = adopted
+	} else {
+		kept[tagAdopted] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	glog.Infof("Adopting existing bucket %q for OBC \"%s/%s\"", bktName, obc.Namespace, obc.Name)
+	if p.recorder != nil {
+		p.recorder.Eventf(obc, corev1.EventTypeNormal, "BucketAdopted",
+			"existing bucket %q was adopted, it is deleted with the claim if the reclaim policy is Delete", bktName)
+	}
+	return kept, nil
+}
+
+// bucketSnapshot is the part of an existing bucket's configuration the
+// operator changes, as it was before, to put back should provisioning
+// fail. Settings the storage class doesn't configure aren't recorded.
+type bucketSnapshot struct {
+	// tags, nil if they aren't changed
+	tags       map[string]string
+	versioning *string
+	lifecycle  []*s3.LifecycleRule
+	encryption *s3.ServerSideEncryptionConfiguration
+	policy     *string
+	lockRule   *s3.ObjectLockRule
+	cors       []*s3.CORSRule
+}
+
+// snapshotBucket records the settings of the bucket cfg changes and, if
+// withTags, its tags.
+func (p *awsS3Provisioner) snapshotBucket(bktName string, cfg *bucketConfig, withTags bool) (*bucketSnapshot, error) {
+
+	snap := &bucketSnapshot{}
+	bkt := aws.String(bktName)
+	if withTags {
+		var err error
+		snap.tags, err = p.getBucketTags(bktName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+		}
+	}
+
+	if cfg.versioning != "" {
+		out, err := p.s3svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: bkt})
+		if err != nil {
+			return nil, fmt.Errorf("error getting versioning of bucket %q: %v", bktName, err)
+		}
+		snap.versioning = out.Status
+	}
+	if cfg.lifecycle != nil {
+		out, err := p.s3svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: bkt})
+		if err != nil && !isAWSErrorCode(err, errNoSuchLifecycleConfig) {
+			return nil, fmt.Errorf("error getting lifecycle rules of bucket %q: %v", bktName, err)
+		}
+		if err == nil {
+			snap.lifecycle = out.Rules
+		}
+	}
+	if cfg.encryption != "" {
+		out, err := p.s3svc.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: bkt})
+		if err != nil && !isAWSErrorCode(err, errNoEncryptionConfig) {
+			return nil, fmt.Errorf("error getting default encryption of bucket %q: %v", bktName, err)
+		}
+		if err == nil {
+			snap.encryption = out.ServerSideEncryptionConfiguration
+		}
+	}
+	if cfg.denyUnencrypted != "" {
+		out, err := p.s3svc.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: bkt})
+		if err != nil && !isAWSErrorCode(err, errNoSuchBucketPolicy) {
+			return nil, fmt.Errorf("error getting policy of bucket %q: %v", bktName, err)
+		}
+		if err == nil {
+			snap.policy = out.Policy
+		}
+	}
+	if cfg.retention != nil {
+		out, err := p.s3svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: bkt})
+		if err != nil {
+			return nil, fmt.Errorf("error getting object lock configuration of bucket %q: %v", bktName, err)
+		}
+		if out.ObjectLockConfiguration != nil {
+			snap.lockRule = out.ObjectLockConfiguration.Rule
+		}
+	}
+	if cfg.cors != nil {
+		out, err := p.s3svc.GetBucketCors(&s3.GetBucketCorsInput{Bucket: bkt})
+		if err != nil && !isAWSErrorCode(err, errNoSuchCORSConfig) {
+			return nil, fmt.Errorf("error getting CORS rules of bucket %q: %v", bktName, err)
+		}
+		if err == nil {
+			snap.cors = out.CORSRules
+		}
+	}
+	return snap, nil
+}
+
+// restoreBucket puts back the tags and settings of a bucket from its
+// snapshot. The operator's own tags are removed, even those left by an
+// earlier attempt, so an adopted bucket isn't taken for one the operator
+// provisioned. Versioning, once enabled, can only be suspended.
+func (p *awsS3Provisioner) restoreBucket(bktName string, snap *bucketSnapshot, cfg *bucketConfig) error {
+
+	bkt := aws.String(bktName)
+	errs := []string{}
+	fail := func(what string, err error) {
+		errs = append(errs, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	if snap.tags != nil {
+		tags := map[string]string{}
+		for k, v := range snap.tags {
+			if !strings.HasPrefix(k, tagPrefix) {
+				tags[k] = v
+			}
+		}
+		if len(tags) == 0 {
+			if _, err := p.s3svc.DeleteBucketTagging(&s3.DeleteBucketTaggingInput{Bucket: bkt}); err != nil {
+				fail("tags", err)
+			}
+		} else if err := p.tagBucket(bktName, tags); err != nil {
+			fail("tags", err)
+		}
+	}
+
+	if cfg.versioning != "" {
+		status := aws.StringValue(snap.versioning)
+		if status == "" {
+			status = s3.BucketVersioningStatusSuspended
+		}
+		_, err := p.s3svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket:                  bkt,
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(status)},
+		})
+		if err != nil {
+			fail("versioning", err)
+		}
+	}
+	if cfg.lifecycle != nil {
+		var err error
+		if len(snap.lifecycle) == 0 {
+			_, err = p.s3svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: bkt})
+		} else {
+			err = p.applyLifecycle(bktName, snap.lifecycle)
+		}
+		if err != nil {
+			fail("lifecycle rules", err)
+		}
+	}
+	if cfg.encryption != "" {
+		var err error
+		if snap.encryption == nil {
+			_, err = p.s3svc.DeleteBucketEncryption(&s3.DeleteBucketEncryptionInput{Bucket: bkt})
+		} else {
+			_, err = p.s3svc.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+				Bucket:                            bkt,
+				ServerSideEncryptionConfiguration: snap.encryption,
+			})
+		}
+		if err != nil {
+			fail("default encryption", err)
+		}
+	}
+	if cfg.denyUnencrypted != "" {
+		var err error
+		if snap.policy == nil {
+			_, err = p.s3svc.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: bkt})
+		} else {
+			_, err = p.s3svc.PutBucketPolicy(&s3.PutBucketPolicyInput{Bucket: bkt, Policy: snap.policy})
+		}
+		if err != nil {
+			fail("bucket policy", err)
+		}
+	}
+	if cfg.retention != nil {
+		_, err := p.s3svc.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+			Bucket: bkt,
+			ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+				ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+				Rule:              snap.lockRule,
+			},
+		})
+		if err != nil {
+			fail("default retention", err)
+		}
+	}
+	if cfg.cors != nil {
+		if err := p.applyCors(bktName, snap.cors); err != nil {
+			fail("CORS rules", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error restoring bucket %q: %s", bktName, strings.Join(errs, "; "))
+	}
+	glog.Infof("restored configuration of bucket %q", bktName)
+	return nil
+}
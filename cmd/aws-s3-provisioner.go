@@ -19,30 +19,39 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	_ "net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 
 	"github.com/golang/glog"
 	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned"
+	informers "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/informers/externalversions"
 	libbkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner"
 	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
 	bkterr "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api/errors"
 
+	corev1 "k8s.io/api/core/v1"
 	storageV1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 )
@@ -53,19 +62,40 @@ const (
 	httpsPort       = 443
 	httpsScheme     = "https"
 	provisionerName = "cloudian-s3.io/bucket"
+	operatorName    = "cloudian-s3-operator"
 	regionInsert    = "<REGION>"
 	s3Hostname      = "s3-" + regionInsert + ".amazonaws.com"
 	s3BucketArn     = "arn:aws:s3:::%s"
-	policyArn       = "arn:aws:iam::%s:policy/%s"
+	policyArn       = "arn:aws:iam::%s:policy%s%s"
 	obStateARN      = "ARN"
 	obStateUser     = "UserName"
+	obStatePolicy   = "BucketPolicySid"
 	maxBucketLen    = 58
-	genUserLen      = 5
+	// longest bucket name used in generated user names
+	maxUserBucketLen = maxBucketLen - 1
+	genUserLen       = 5
+	maxUserNameLen   = 64
+	// longest namespace (a DNS label) and object names (DNS subdomains)
+	maxNamespaceLen  = 63
+	maxObjectNameLen = 253
+	maxUserAttempts  = 10
 )
 
 var (
-	kubeconfig string
-	masterURL  string
+	kubeconfig        string
+	masterURL         string
+	clusterID         string
+	iamPathPrefix     string
+	metricsAddr       string
+	gcInterval        time.Duration
+	gcDelete          bool
+	gcMinAge          time.Duration
+	webhookAddr       string
+	webhookCert       string
+	webhookKey        string
+	purgeConc         int
+	asyncDelete       bool
+	reconcileInterval time.Duration
 )
 
 type awsS3Provisioner struct {
@@ -73,16 +103,18 @@ type awsS3Provisioner struct {
 	region     string
 	// s3Endpoint is the url used to connect to the s3 server, or nil to use default
 	s3Endpoint *url.URL
+	// iamEndpoint is the url used to connect to the iam server, or nil to use default
+	iamEndpoint *url.URL
 	// s3session is the aws session for s3 operations
 	s3Session *session.Session
 	// s3svc is the aws s3 service based on the session
-	s3svc *s3.S3
+	s3svc s3iface.S3API
 	// iam3session is the aws session for IAM operations
 	iamSession *session.Session
 	// iam client service
-	iamsvc *awsuser.IAM
+	iamsvc iamiface.IAMAPI
 	//kube client
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 	// access keys for aws acct for the bucket *owner*
 	bktOwnerAccessId   string
 	bktOwnerSecretKey  string
@@ -93,6 +125,42 @@ type awsS3Provisioner struct {
 	bktUserSecretKey   string
 	bktUserAccountId   string
 	bktUserPolicyArn   string
+	// grant the bucket claim user access using a bucket policy
+	bktPolicyAccess bool
+	// Sid prefix of the bucket policy statements granting access
+	bktPolicySid string
+	// where the bucket claim user's access keys came from
+	bktCredSource string
+	// namespace/name of the secret holding the owner access keys
+	bktOwnerSecret string
+	// configuration applied to a new bucket
+	bktConfig *bucketConfig
+	// tags from the labels of the storage class and OBC
+	bktUserTags map[string]string
+	// location constraint of a new bucket
+	bktLocation string
+	// name of the storage policy, if set by name
+	bktStoragePolicyName string
+	// clusterID identifies this cluster in the tags of created entities
+	clusterID string
+	// iamPathPrefix is the path prefix of created IAM users and policies
+	iamPathPrefix string
+	// purgeConcurrency bounds the parallel requests deleting a bucket's objects
+	purgeConcurrency int
+	// deleter deletes buckets in the background, nil to delete them in Delete
+	deleter *bucketDeleter
+	// time between the deletion of a claim and the purge of its bucket
+	deleteGracePeriod time.Duration
+	// only delete empty buckets, or never delete them
+	deleteOnlyIfEmpty bool
+	retainData        bool
+	// the bucket existed and was adopted rather than created
+	bktAdopted bool
+	// what this Provision or Grant, or an earlier interrupted one, created
+	journal *provisionJournal
+	// client of ObjectBuckets and recorder of events on them
+	libClientset versioned.Interface
+	recorder     record.EventRecorder
 }
 
 func NewAwsS3Provisioner(cfg *restclient.Config, s3Provisioner awsS3Provisioner) (*libbkt.Provisioner, error) {
@@ -113,6 +181,12 @@ func awsDefaultSession() (*session.Session, error) {
 // Return the OB struct with minimal fields filled in.
 func (p *awsS3Provisioner) rtnObjectBkt(bktName string) *v1alpha1.ObjectBucket {
 
+	// settings of the bucket reported in the OBC's ConfigMap
+	configData := map[string]string{}
+	if p.bktConfig != nil {
+		configData = p.bktConfig.configData()
+	}
+
 	var host string
 	var port int
 	if p.s3Endpoint != nil {
@@ -129,13 +203,11 @@ func (p *awsS3Provisioner) rtnObjectBkt(bktName string) *v1alpha1.ObjectBucket {
 
 	conn := &v1alpha1.Connection{
 		Endpoint: &v1alpha1.Endpoint{
-			BucketHost: host,
-			BucketPort: port,
-			BucketName: bktName,
-			Region:     p.region,
-			AdditionalConfigData: map[string]string{
-				"": "",
-			},
+			BucketHost:           host,
+			BucketPort:           port,
+			BucketName:           bktName,
+			Region:               p.region,
+			AdditionalConfigData: configData,
 		},
 		Authentication: &v1alpha1.Authentication{
 			AccessKeys: &v1alpha1.AccessKeys{
@@ -143,10 +215,7 @@ func (p *awsS3Provisioner) rtnObjectBkt(bktName string) *v1alpha1.ObjectBucket {
 				SecretAccessKey: p.bktUserSecretKey,
 			},
 		},
-		AdditionalState: map[string]string{
-			obStateARN:  p.bktUserPolicyArn,
-			obStateUser: p.bktUserName,
-		},
+		AdditionalState: p.obState(),
 	}
 
 	return &v1alpha1.ObjectBucket{
@@ -159,7 +228,12 @@ func (p *awsS3Provisioner) rtnObjectBkt(bktName string) *v1alpha1.ObjectBucket {
 func (p *awsS3Provisioner) createBucket(bktName string) error {
 
 	bucketinput := &s3.CreateBucketInput{
-		Bucket: &bktName,
+		Bucket:                    &bktName,
+		CreateBucketConfiguration: createBucketConfiguration(p.bktLocation),
+	}
+	// object lock can only be enabled when the bucket is created
+	if p.bktConfig != nil && p.bktConfig.objectLock {
+		bucketinput.ObjectLockEnabledForBucket = aws.Bool(true)
 	}
 
 	req, _ := p.s3svc.CreateBucketRequest(bucketinput)
@@ -175,6 +249,16 @@ func (p *awsS3Provisioner) createBucket(bktName string) error {
 				glog.Errorf(msg)
 				return bkterr.NewBucketExistsError(msg)
 			case s3.ErrCodeBucketAlreadyOwnedByYou:
+				// an interrupted attempt created the bucket
+				if p.journal != nil && p.journal.Bucket == bktName {
+					glog.Infof("Bucket %s was created by an earlier attempt", bktName)
+					return nil
+				}
+				// the storage class may accept the account's existing buckets
+				if p.bktConfig != nil && p.bktConfig.adoptExisting {
+					p.bktAdopted = true
+					return nil
+				}
 				msg := fmt.Sprintf("Bucket %q already owned by you", bktName)
 				glog.Errorf(msg)
 				return bkterr.NewBucketExistsError(msg)
@@ -201,21 +285,21 @@ func (p *awsS3Provisioner) awsConfig(endpoint *url.URL) *aws.Config {
 	return cfg
 }
 
+// Set in the receiver the aws default session and region.
+func (p *awsS3Provisioner) setDefaultSessions() error {
+	var err error
+	p.region = defaultRegion
+	p.s3Session, err = awsDefaultSession()
+	p.iamSession = p.s3Session
+	return err
+}
+
 // Create an aws session based on the OBC's storage class's secret and region.
 // Set in the receiver the session and region used to create the session.
 // Note: in error cases it's possible that the set region is different from
 //   the OBC's storage class's region.
 func (p *awsS3Provisioner) awsSessionFromStorageClass(sc *storageV1.StorageClass) error {
 
-	// helper func var for error returns
-	var errDefault = func() error {
-		var err error
-		p.region = defaultRegion
-		p.s3Session, err = awsDefaultSession()
-		p.iamSession = p.s3Session
-		return err
-	}
-
 	region := getRegion(sc)
 	if region == "" {
 		glog.Infof("region is empty in storage class %q, default region %q used", sc.Name, defaultRegion)
@@ -224,17 +308,8 @@ func (p *awsS3Provisioner) awsSessionFromStorageClass(sc *storageV1.StorageClass
 	secretNS, secretName := getSecretName(sc)
 	if secretNS == "" || secretName == "" {
 		glog.Infof("secret name or namespace are empty in storage class %q", sc.Name)
-		return errDefault()
-	}
-
-	// get the sc's bucket owner secret
-	accessKeyId, secretKey, err := credsFromSecret(p.clientset, secretNS, secretName)
-	if err != nil {
-		glog.Warningf("secret \"%s/%s\" in storage class %q for %q is empty.\nUsing default credentials.", secretNS, secretName, sc.Name, p.bucketName)
-		return errDefault()
+		return p.setDefaultSessions()
 	}
-	p.bktOwnerAccessId = accessKeyId
-	p.bktOwnerSecretKey = secretKey
 
 	// get the s3 and iam endpoints
 	s3URL, err := getS3ApiURL(sc)
@@ -248,10 +323,29 @@ func (p *awsS3Provisioner) awsSessionFromStorageClass(sc *storageV1.StorageClass
 		return err
 	}
 
-	// use the OBC's SC to create our sessions, set receiver fields
-	glog.V(2).Infof("Creating S3 session using credentials from storage class %s's secret", sc.Name)
+	return p.awsSession(fmt.Sprintf("storage class %q", sc.Name), region, secretNS, secretName, s3URL, iamURL)
+}
+
+// Create the aws sessions for the endpoints using the bucket owner
+// credentials in the secret, falling back to the default session if the
+// secret is empty. source names where the settings came from, for logging.
+func (p *awsS3Provisioner) awsSession(source, region, secretNS, secretName string, s3URL, iamURL *url.URL) error {
+
+	// get the bucket owner secret
+	accessKeyId, secretKey, err := credsFromSecret(p.clientset, secretNS, secretName)
+	if err != nil {
+		glog.Warningf("secret \"%s/%s\" in %s for %q is empty.\nUsing default credentials.", secretNS, secretName, source, p.bucketName)
+		return p.setDefaultSessions()
+	}
+	p.bktOwnerAccessId = accessKeyId
+	p.bktOwnerSecretKey = secretKey
+	p.bktOwnerSecret = secretNS + "/" + secretName
+
+	// create our sessions, set receiver fields
+	glog.V(2).Infof("Creating S3 session using credentials from %s's secret", source)
 	p.region = region
 	p.s3Endpoint = s3URL
+	p.iamEndpoint = iamURL
 	p.s3Session, err = session.NewSession(p.awsConfig(s3URL))
 	if err == nil {
 		p.iamSession, err = session.NewSession(p.awsConfig(iamURL))
@@ -274,6 +368,7 @@ func (p *awsS3Provisioner) setSessionAndService(sc *storageV1.StorageClass) erro
 	if p.s3svc == nil {
 		return fmt.Errorf("error creating S3 service: %v", err)
 	}
+	p.iamsvc = awsuser.New(p.iamSession)
 
 	return nil
 }
@@ -294,13 +389,47 @@ func (p *awsS3Provisioner) initializeCreateOrGrant(options *apibkt.BucketOptions
 		return err
 	}
 
+	// the storage class may be restricted to some namespaces
+	if !namespaceAllowed(sc.Parameters, obc.Namespace) {
+		return fmt.Errorf("storage class %q can't be used by OBC \"%s/%s\", namespace not allowed", sc.Name, obc.Namespace, obc.Name)
+	}
+
+	// resume what an interrupted attempt created
+	p.journal, err = loadJournal(p.clientset, obc)
+	if err != nil {
+		return err
+	}
+
 	// check for bkt user access policy vs. bkt owner policy based on SC
 	p.setCreateBucketUserOptions(sc)
+	p.setBucketPolicyAccessOptions(sc)
+
+	// copy the labels selected by the storage class to the bucket's tags
+	p.bktUserTags = labelTags(sc.Parameters[scTagLabelPrefix], sc.Labels, obc.Labels)
 
-	// check if storage policy is defined
-	const scPolicy = "storagePolicyId"
-	if policy, ok := sc.Parameters[scPolicy]; ok {
-		p.bktStoragePolicyId = policy
+	// buckets may be kept for a while after their claim is deleted, or
+	// for good
+	p.deleteGracePeriod, err = getDeleteGracePeriod(sc.Parameters)
+	if err != nil {
+		return err
+	}
+	p.setDeletionOptions(sc.Parameters)
+
+	// check if storage policy is defined, by id or name. When the Admin API
+	// can't resolve the name, use the policy recorded when the claim was
+	// provisioned before; granting access to an existing bucket doesn't
+	// need the policy at all
+	p.bktStoragePolicyId, p.bktStoragePolicyName, err = getStoragePolicy(p.clientset, sc)
+	if err != nil {
+		if id, name, ok := p.recordedStoragePolicy(obc); ok {
+			glog.Warningf("using storage policy %q recorded for OBC \"%s/%s\": %v", id, obc.Namespace, obc.Name, err)
+			p.bktStoragePolicyId, p.bktStoragePolicyName = id, name
+		} else if sc.Parameters[v1alpha1.StorageClassBucket] != "" {
+			glog.Warningf("ignoring storage policy of OBC \"%s/%s\" for existing bucket: %v", obc.Namespace, obc.Name, err)
+		} else {
+			glog.Errorf("invalid storage policy for OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+			return err
+		}
 	}
 
 	// set the aws session and s3 service from the storage class
@@ -309,39 +438,65 @@ func (p *awsS3Provisioner) initializeCreateOrGrant(options *apibkt.BucketOptions
 		return fmt.Errorf("error using OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
 	}
 
+	// new buckets are only placed in a location if the storage class sets one
+	p.bktLocation = bucketLocation(sc.Parameters, getRegion(sc))
+
 	return nil
 }
 
 // initializeUserAndPolicy sets commonly used provisioner
 // receiver fields, generates a unique username and calls
 // handleUserandPolicy.
-func (p *awsS3Provisioner) initializeUserAndPolicy(options *apibkt.BucketOptions) error {
+func (p *awsS3Provisioner) initializeUserAndPolicy(s *saga, options *apibkt.BucketOptions) error {
 
 	scName := options.ObjectBucketClaim.Spec.StorageClassName
 	var err error
 	var uAccess, uKey string
 
 	if p.bktCreateUser == "yes" {
-		//Create IAM service (maybe this should be added into our default or obc session
-		//or create all services type of function?
-		p.iamsvc = awsuser.New(p.iamSession)
+		p.bktCredSource = credSourceIAMUser
 
 		// Create a new IAM user using the name of the bucket and set
-		// access and attach policy for bucket and user
-		p.bktUserName = p.createUserName(p.bucketName)
+		// access and attach policy for bucket and user, or resume with
+		// the user of an interrupted attempt
+		if p.journal != nil && p.journal.User != "" {
+			p.bktUserName = p.journal.User
+		} else {
+			p.bktUserName, err = p.createUserName(p.bucketName, options)
+			if err != nil {
+				return err
+			}
+		}
 
 		// handle all iam and policy operations
-		uAccess, uKey, err = p.handleUserAndPolicy(p.bucketName, options)
+		uAccess, uKey, err = p.handleUserAndPolicy(s, p.bucketName, options)
 	} else if uSecretName, ok := options.Parameters["bucketClaimUserSecretName"]; ok {
 		// Extract the bucket user secret
 		uSecretNS := options.Parameters["bucketClaimUserSecretNamespace"]
+		p.bktCredSource = credSourceUserSecret + ":" + uSecretNS + "/" + uSecretName
 		// get the sc's bucket owner secret
 		uAccess, uKey, err = credsFromSecret(p.clientset, uSecretNS, uSecretName)
 		if err != nil {
 			glog.Errorf("secret \"%s/%s\" in storage class %s for %q is invalid: %v", uSecretNS, uSecretName, scName, p.bucketName, err)
+		} else if p.bktPolicyAccess {
+			// grant the secret's principal access in the bucket policy
+			var principal map[string]string
+			principal, err = principalFromSecret(p.clientset, uSecretNS, uSecretName)
+			if err != nil {
+				glog.Errorf("secret \"%s/%s\" in storage class %s for %q has no principal: %v", uSecretNS, uSecretName, scName, p.bucketName, err)
+			} else {
+				err = s.run("grant access in bucket policy", func() error {
+					return p.grantBucketPolicyAccess(p.bucketName, principal, options)
+				}, func() error {
+					return p.revokeBucketPolicyAccess(p.bucketName)
+				})
+			}
 		}
+	} else if p.bktPolicyAccess {
+		err = fmt.Errorf("storage class %s grants access by bucket policy but has no bucketClaimUserSecretName", scName)
 	} else {
 		// Default to using the bucket owner creds
+		p.bktCredSource = credSourceOwner
 		uAccess = p.bktOwnerAccessId
 		uKey = p.bktOwnerSecretKey
 	}
@@ -369,7 +524,9 @@ func (p *awsS3Provisioner) checkIfBucketExists(name string) bool {
 	return true
 }
 
-func (p *awsS3Provisioner) checkIfUserExists(name string) bool {
+// checkIfUserExists returns true if GetUser finds the user, false if it
+// doesn't exist, or an error if existence couldn't be determined.
+func (p *awsS3Provisioner) checkIfUserExists(name string) (bool, error) {
 
 	input := &awsuser.GetUserInput{
 		UserName: aws.String(name),
@@ -377,10 +534,13 @@ func (p *awsS3Provisioner) checkIfUserExists(name string) bool {
 
 	_, err := p.iamsvc.GetUser(input)
 	if err != nil {
-		return err.(awserr.Error).Code() == awsuser.ErrCodeEntityAlreadyExistsException
+		if isNoSuchEntityError(err) {
+			return false, nil
+		}
+		return false, err
 	}
 
-	return false
+	return true, nil
 }
 
 // Provision creates an aws s3 bucket and returns a connection info
@@ -399,39 +559,104 @@ func (p awsS3Provisioner) Provision(options *apibkt.BucketOptions) (*v1alpha1.Ob
 		return nil, err
 	}
 
-	// create the bucket
-	glog.Infof("Creating bucket %q", p.bucketName)
-	err = p.createBucket(p.bucketName)
+	// get the configuration to apply to the new bucket
+	p.bktConfig, err = getBucketConfig(options.Parameters, options.ObjectBucketClaim)
 	if err != nil {
-		err = fmt.Errorf("error creating bucket %q: %v", p.bucketName, err)
-		glog.Errorf(err.Error())
 		return nil, err
 	}
-	// If we have a failure in the remainder of the provisioning, delete this bucket
-	defer func() {
+
+	// create and configure the bucket, then deal with user and policy,
+	// undoing it all if a step fails
+	s := newSaga(fmt.Sprintf("provisioning bucket %q", p.bucketName))
+	err = p.provisionBucket(s, options)
+	if err != nil {
+		return nil, p.abort(s, err)
+	}
+
+	// returned ob with connection info
+	return p.rtnObjectBkt(p.bucketName), nil
+}
+
+// provisionBucket runs the steps creating the bucket and the access to it.
+func (p *awsS3Provisioner) provisionBucket(s *saga, options *apibkt.BucketOptions) error {
+
+	glog.Infof("Creating bucket %q", p.bucketName)
+	err := s.run("create bucket", func() error {
+		return p.createBucket(p.bucketName)
+	}, func() error {
+		// an adopted bucket existed before
+		if p.bktAdopted {
+			return nil
+		}
+		_, err := p.s3svc.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(p.bucketName)})
+		if err != nil && !isNoSuchBucketError(err) {
+			return err
+		}
+		p.journal.forget(func(j *provisionJournal) { j.Bucket = "" })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !p.bktAdopted {
+		err = s.run("journal bucket", func() error {
+			return p.journal.record(func(j *provisionJournal) { j.Bucket = p.bucketName })
+		}, nil)
 		if err != nil {
-			_, delerr := p.s3svc.DeleteBucket(&s3.DeleteBucketInput{
-				Bucket: aws.String(p.bucketName),
-			})
-			if delerr != nil {
-				glog.Errorf("Error undoing bucket creation %s: %v", p.bucketName, delerr)
+			return err
+		}
+	}
+
+	// an adopted bucket keeps its tags, and gets them back along with its
+	// configuration if provisioning fails
+	userTags := p.bktUserTags
+	if p.bktAdopted {
+		var snap *bucketSnapshot
+		err = s.run("adopt bucket", func() (err error) {
+			userTags, err = p.adoptBucket(p.bucketName, options)
+			if err != nil {
+				return err
 			}
+			snap, err = p.snapshotBucket(p.bucketName, p.bktConfig, true)
+			return err
+		}, func() error {
+			return p.restoreBucket(p.bucketName, snap, p.bktConfig)
+		})
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	// createBucket was successful, deal with user and policy
-	// Bucket does exist, attach new user and policy wrapper
-	// calling initializeCreateOrGrant
-	// TODO: we currently are catching an error that is always nil
-	err = p.initializeUserAndPolicy(options)
+	// tag the bucket with the cluster and claim it belongs to
+	err = s.run("tag bucket", func() error {
+		return p.tagBucket(p.bucketName, bucketTags(p.ownerTags(options), userTags))
+	}, nil)
 	if err != nil {
-		err = fmt.Errorf("error creating user for bucket %q: %v", p.bucketName, err)
-		glog.Errorf(err.Error())
-		return nil, err
+		return err
 	}
 
-	// returned ob with connection info
-	return p.rtnObjectBkt(p.bucketName), nil
+	// configure the bucket
+	err = s.run("configure bucket", func() error {
+		return p.applyBucketConfig(p.bucketName, p.bktConfig)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// createBucket was successful, deal with user and policy
+	return p.initializeUserAndPolicy(s, options)
+}
+
+// abort undoes the completed steps of the saga after err failed it, and
+// keeps what's left in the journal for the next attempt.
+func (p *awsS3Provisioner) abort(s *saga, err error) error {
+
+	err = s.compensate(err)
+	glog.Errorf(err.Error())
+	if jerr := p.journal.save(); jerr != nil {
+		glog.Errorf(jerr.Error())
+	}
+	return err
 }
 
 // Grant attaches to an existing aws s3 bucket and returns a connection info
@@ -450,16 +675,52 @@ func (p awsS3Provisioner) Grant(options *apibkt.BucketOptions) (*v1alpha1.Object
 		return nil, fmt.Errorf("bucket %s does not exist", p.bucketName)
 	}
 
-	// Bucket does exist, attach new user and policy wrapper
-	// calling initializeUserAndPolicy
-	// TODO: we currently are catching an error that is always nil
-	err = p.initializeUserAndPolicy(options)
+	// don't touch a bucket provisioned by another cluster
+	err = p.checkBucketOwner(p.bucketName, nil)
+	if err != nil {
+		glog.Errorf(err.Error())
+		return nil, err
+	}
+
+	// check the bucket is where the storage class says, or find out where
+	err = p.checkBucketLocation(p.bucketName, options.Parameters)
 	if err != nil {
-		err = fmt.Errorf("error creating user for bucket %q: %v", p.bucketName, err)
 		glog.Errorf(err.Error())
 		return nil, err
 	}
 
+	// Bucket does exist, configure it if the storage class allows it and
+	// attach new user and policy wrapper, undoing it all if a step fails
+	s := newSaga(fmt.Sprintf("granting access to bucket %q", p.bucketName))
+	if modifyExisting(options.Parameters) {
+		cfg, err := getBucketConfig(options.Parameters, options.ObjectBucketClaim)
+		if err != nil {
+			return nil, err
+		}
+		p.bktConfig = cfg.existingBucketConfig()
+		// the configuration is put back even if applying it fails halfway
+		var snap *bucketSnapshot
+		err = s.run("snapshot bucket configuration", func() (err error) {
+			snap, err = p.snapshotBucket(p.bucketName, p.bktConfig, false)
+			return err
+		}, func() error {
+			return p.restoreBucket(p.bucketName, snap, p.bktConfig)
+		})
+		if err != nil {
+			return nil, p.abort(s, err)
+		}
+		err = s.run("configure bucket", func() error {
+			return p.applyBucketConfig(p.bucketName, p.bktConfig)
+		}, nil)
+		if err != nil {
+			return nil, p.abort(s, err)
+		}
+	}
+	err = p.initializeUserAndPolicy(s, options)
+	if err != nil {
+		return nil, p.abort(s, err)
+	}
+
 	// returned ob with connection info
 	// TODO: assuming this is the same Green vs Brown?
 	return p.rtnObjectBkt(p.bucketName), nil
@@ -469,50 +730,69 @@ func (p awsS3Provisioner) Grant(options *apibkt.BucketOptions) (*v1alpha1.Object
 // Note: only called when the bucket's reclaim policy is "delete".
 func (p awsS3Provisioner) Delete(ob *v1alpha1.ObjectBucket) error {
 
-	// set receiver fields from OB data
-	p.bucketName = ob.Spec.Endpoint.BucketName
-	p.bktUserPolicyArn = ob.Spec.AdditionalState[obStateARN]
-	p.bktUserName = ob.Spec.AdditionalState[obStateUser]
-	scName := ob.Spec.StorageClassName
-	glog.Infof("Deleting bucket %q for OB %q", p.bucketName, ob.Name)
+	glog.Infof("Deleting bucket %q for OB %q", ob.Spec.Endpoint.BucketName, ob.Name)
 
-	// get the OB and its storage class
-	sc, err := p.getClassByNameForBucket(scName)
+	// set receiver fields, the aws session and s3 service from the
+	// state recorded in the OB
+	err := p.setFromObState(ob)
 	if err != nil {
-		return fmt.Errorf("failed to get storage class for OB %q: %v", ob.Name, err)
+		return err
 	}
 
-	// set the aws session and s3 service from the storage class
-	err = p.setSessionAndService(sc)
+	// only delete the bucket provisioned for this OB's claim
+	err = p.checkBucketOwner(p.bucketName, ob)
 	if err != nil {
-		return fmt.Errorf("error using OB %q: %v", ob.Name, err)
+		return err
 	}
 
-	// Delete IAM Policy and User
-	p.setCreateBucketUserOptions(sc)
-	err = p.handleUserAndPolicyDeletion(p.bucketName)
-	if err != nil {
-		glog.Errorf("Failed to delete Policy and/or User - manual clean up required")
-		return fmt.Errorf("Error deleting Policy and/or User %v", err)
+	// Delete IAM Policy and User, unless that was done before the
+	// background deletion of the bucket started
+	if p.deleter == nil || !p.deleter.started(ob) {
+		// refuse to delete protected buckets, or buckets with objects
+		// if the storage class only deletes empty ones
+		err = p.checkDeletionAllowed(ob)
+		if err != nil {
+			return err
+		}
+
+		err = p.handleUserAndPolicyDeletion(p.bucketName)
+		if err != nil {
+			glog.Errorf("Failed to delete Policy and/or User - manual clean up required")
+			return fmt.Errorf("Error deleting Policy and/or User %v", err)
+		}
 	}
 
-	// Delete Bucket
-	iter := s3manager.NewDeleteListIterator(p.s3svc, &s3.ListObjectsInput{
-		Bucket: aws.String(p.bucketName),
-	})
+	// Keep the data, only the claim's access to it is removed
+	if p.retainData {
+		err = p.retainBucket(p.bucketName)
+		if err != nil {
+			return err
+		}
+		p.eventf(ob, corev1.EventTypeNormal, "BucketRetained",
+			"bucket %q is kept as its storage class retains data, its claim's credentials were revoked", p.bucketName)
+		glog.Infof("Keeping bucket %q from OB %q, storage class retains data", p.bucketName, ob.Name)
+		return nil
+	}
 
-	glog.V(2).Infof("Deleting all objects in bucket %q (from OB %q)", p.bucketName, ob.Name)
-	err = s3manager.NewBatchDeleteWithClient(p.s3svc).Delete(aws.BackgroundContext(), iter)
-	if err != nil && !isNoSuchBucketError(err) {
-		return fmt.Errorf("Error deleting objects from bucket %q: %v", p.bucketName, err)
+	// Keep the bucket, inaccessible, during the grace period
+	retain, err := p.softDelete(ob)
+	if err != nil {
+		glog.Errorf(err.Error())
+		return err
+	}
+	if retain {
+		glog.Infof("Keeping undeleted bucket %q from OB %q", p.bucketName, ob.Name)
+		return nil
 	}
 
-	glog.V(2).Infof("Deleting empty bucket %q from OB %q", p.bucketName, ob.Name)
-	_, err = p.s3svc.DeleteBucket(&s3.DeleteBucketInput{
-		Bucket: aws.String(p.bucketName),
-	})
-	if err != nil && !isNoSuchBucketError(err) {
-		return fmt.Errorf("Error deleting empty bucket %q: %v", p.bucketName, err)
+	// Delete Bucket
+	glog.V(2).Infof("Deleting bucket %q and all its objects (from OB %q)", p.bucketName, ob.Name)
+	if p.deleter != nil {
+		return p.deleter.deleteBucket(p, ob)
+	}
+	err = p.purgeBucket(p.bucketName)
+	if err != nil {
+		return err
 	}
 	glog.Infof("Deleted bucket %q from OB %q", p.bucketName, ob.Name)
 
@@ -521,27 +801,32 @@ func (p awsS3Provisioner) Delete(ob *v1alpha1.ObjectBucket) error {
 
 // Revoke removes a user, policy and access keys from an existing bucket.
 func (p awsS3Provisioner) Revoke(ob *v1alpha1.ObjectBucket) error {
-	// set receiver fields from OB data
-	p.bucketName = ob.Spec.Endpoint.BucketName
-	p.bktUserPolicyArn = ob.Spec.AdditionalState[obStateARN]
-	p.bktUserName = ob.Spec.AdditionalState[obStateUser]
-	scName := ob.Spec.StorageClassName
-	glog.Infof("Revoking access to bucket %q for OB %q", p.bucketName, ob.Name)
-
-	// get the OB and its storage class
-	sc, err := p.getClassByNameForBucket(scName)
+	glog.Infof("Revoking access to bucket %q for OB %q", ob.Spec.Endpoint.BucketName, ob.Name)
+
+	// set receiver fields, the aws session and s3 service from the
+	// state recorded in the OB
+	err := p.setFromObState(ob)
 	if err != nil {
-		return fmt.Errorf("failed to get storage class for OB %q: %v", ob.Name, err)
+		return err
 	}
 
-	// set the aws session and s3 service from the storage class
-	err = p.setSessionAndService(sc)
+	// don't touch a bucket provisioned by another cluster
+	err = p.checkBucketOwner(p.bucketName, nil)
+	if err != nil {
+		glog.Errorf(err.Error())
+		return err
+	}
+
+	// A bucket provisioned for the claim, whose reclaim policy is Retain,
+	// is left behind once its OB is deleted, keep the garbage collector
+	// from taking it for an orphan
+	err = p.retainClaimBucket(ob)
 	if err != nil {
-		return fmt.Errorf("error using OB %q: %v", ob.Name, err)
+		glog.Errorf(err.Error())
+		return err
 	}
 
 	// Delete IAM Policy and User
-	p.setCreateBucketUserOptions(sc)
 	err = p.handleUserAndPolicyDeletion(p.bucketName)
 	if err != nil {
 		// We are currently only logging
@@ -582,8 +867,63 @@ func main() {
 
 	stopCh := handleSignals()
 
+	if clusterID == "" {
+		var err error
+		clusterID, err = defaultClusterID(clientset)
+		if err != nil {
+			glog.Errorf("killing Cloudian S3 operator, error getting cluster id: %v", err)
+			os.Exit(1)
+		}
+	}
+	glog.V(2).Infof("main: cluster id %q", clusterID)
+
 	s3Prov := awsS3Provisioner{}
 	s3Prov.clientset = clientset
+	s3Prov.clusterID = clusterID
+	s3Prov.iamPathPrefix = iamPathPrefix
+	s3Prov.purgeConcurrency = purgeConc
+
+	// Serve the metrics published with expvar
+	if metricsAddr != "" {
+		go func() {
+			glog.Errorf("metrics server exited: %v", http.ListenAndServe(metricsAddr, nil))
+		}()
+	}
+
+	// Serve the validating admission webhooks
+	if webhookAddr != "" {
+		go func() {
+			glog.Errorf("webhook server exited: %v", serveWebhooks(clientset, webhookAddr, webhookCert, webhookKey))
+		}()
+	}
+
+	libClientset := versioned.NewForConfigOrDie(config)
+	s3Prov.libClientset = libClientset
+	// one recorder, and so one event broadcaster, for all the events
+	recorder := newEventRecorder(clientset)
+	s3Prov.recorder = recorder
+	if asyncDelete {
+		s3Prov.deleter = newBucketDeleter(libClientset)
+	}
+
+	// Report storage classes naming storage policies which can't be used
+	go validateStoragePolicies(clientset, recorder)
+
+	// Start the reconciler of claims' buckets, which revisits every bucket
+	// each reconcile interval
+	informerFactory := informers.NewSharedInformerFactory(libClientset, reconcileInterval)
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(clientset, 0)
+	reconciler := newBucketReconciler(s3Prov, libClientset, informerFactory, kubeInformerFactory)
+	informerFactory.Start(stopCh)
+	kubeInformerFactory.Start(stopCh)
+	go reconciler.Run(stopCh)
+
+	// Start the opt-in garbage collector of orphaned users, policies and buckets
+	if gcInterval > 0 {
+		gc := newGarbageCollector(s3Prov, libClientset, recorder, gcDelete, gcMinAge)
+		glog.V(2).Infof("main: running garbage collector every %v", gcInterval)
+		go wait.Until(gc.run, gcInterval, stopCh)
+	}
 
 	// Create and run the s3 provisioner controller.
 	// It implements the Provisioner interface expected by the bucket
@@ -610,6 +950,18 @@ func handleFlags() {
 
 	flag.StringVar(&kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", os.Getenv("MASTER"), "(Deprecated: use `--kubeconfig`) The address of the Kubernetes API server. Overrides kubeconfig. Only required if out-of-cluster.")
+	flag.StringVar(&clusterID, "cluster-id", os.Getenv("CLUSTER_ID"), "Identifies this cluster in the tags of created users, policies and buckets. Defaults to the UID of the kube-system namespace.")
+	flag.StringVar(&iamPathPrefix, "iam-path-prefix", defaultIAMPathPrefix, "Path prefix of the IAM users and policies created by the operator. The cluster id is appended to it.")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve metrics on at /debug/vars, for example \":8080\". Metrics aren't served if empty.")
+	flag.DurationVar(&gcInterval, "gc-interval", 0, "Interval between checks for orphaned IAM users, policies and buckets. Disabled if 0.")
+	flag.BoolVar(&gcDelete, "gc-delete", false, "Delete orphaned IAM users, policies and buckets found by the garbage collector.")
+	flag.DurationVar(&gcMinAge, "gc-min-age", 24*time.Hour, "Minimum age of orphans deleted when --gc-delete is set.")
+	flag.IntVar(&purgeConc, "purge-concurrency", defaultPurgeConcurrency, "Number of parallel requests deleting the objects of a bucket.")
+	flag.BoolVar(&asyncDelete, "async-delete", true, "Delete buckets in the background, checkpointing the progress in the ObjectBucket, rather than in the controller worker.")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 10*time.Minute, "Interval between reconciles of every bound claim's bucket and IAM policy with the backend. Buckets are only reconciled on changes if 0.")
+	flag.StringVar(&webhookAddr, "webhook-addr", "", "Address to serve the validating admission webhooks on, for example \":9443\". Webhooks aren't served if empty.")
+	flag.StringVar(&webhookCert, "webhook-cert-file", "/etc/webhook/certs/tls.crt", "TLS certificate of the admission webhook server.")
+	flag.StringVar(&webhookKey, "webhook-key-file", "/etc/webhook/certs/tls.key", "TLS private key of the admission webhook server.")
 
 	if !flag.Parsed() {
 		flag.Parse()
@@ -0,0 +1,210 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+)
+
+const (
+	// storage class parameter listing the keys an OBC's additionalConfig
+	// may override
+	scClaimOverrides = "allowClaimOverrides"
+	// storage class parameter allowing the operator to configure existing
+	// (brownfield) buckets
+	scModifyExisting = "modifyExistingBucket"
+	// bucket configuration keys
+	cfgVersioning = "versioning"
+)
+
+// bucketConfig is the configuration applied to a bucket after it's created.
+// Empty fields are left as the bucket has them.
+type bucketConfig struct {
+	// versioning is "Enabled" or "Suspended"
+	versioning string
+	// lifecycle rules, nil if none are configured
+	lifecycle []*s3.LifecycleRule
+	// default server side encryption, "SSE-S3" or "SSE-KMS", and KMS key
+	encryption string
+	kmsKeyID   string
+	// "yes" to deny uploads without encryption headers, "no" to allow them
+	denyUnencrypted string
+	// objectLock enables object lock, only possible when creating a bucket
+	objectLock bool
+	// default retention mode and period, nil if not configured
+	retentionMode string
+	retention     *s3.DefaultRetention
+	// CORS rules, nil if not configured, empty to remove them
+	cors []*s3.CORSRule
+	// adoptExisting accepts an existing bucket of the account as the new
+	// bucket
+	adoptExisting bool
+	// exclusive makes the configuration the bucket's whole configuration:
+	// lifecycle rules, CORS rules, default encryption and the statement
+	// denying unencrypted uploads are removed unless configured
+	exclusive bool
+}
+
+// claimOverrides returns the keys the storage class allows an OBC to
+// override in its additionalConfig.
+func claimOverrides(params map[string]string) map[string]bool {
+
+	allowed := map[string]bool{}
+	for _, key := range strings.Split(params[scClaimOverrides], ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			allowed[key] = true
+		}
+	}
+	return allowed
+}
+
+// configValue returns the value of key from the OBC's additionalConfig if
+// the storage class allows overriding it, otherwise the storage class's.
+func configValue(params map[string]string, obc *v1alpha1.ObjectBucketClaim, key string) string {
+
+	if obc != nil && claimOverrides(params)[key] {
+		if v, ok := obc.Spec.AdditionalConfig[key]; ok {
+			return v
+		}
+	}
+	return params[key]
+}
+
+// getBucketConfig returns the bucket configuration from the storage class
+// parameters and the OBC.
+func getBucketConfig(params map[string]string, obc *v1alpha1.ObjectBucketClaim) (*bucketConfig, error) {
+
+	cfg := &bucketConfig{}
+
+	cfg.versioning = configValue(params, obc, cfgVersioning)
+	switch cfg.versioning {
+	case "", s3.BucketVersioningStatusEnabled, s3.BucketVersioningStatusSuspended:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, must be %q or %q", cfgVersioning, cfg.versioning,
+			s3.BucketVersioningStatusEnabled, s3.BucketVersioningStatusSuspended)
+	}
+
+	lifecycle, err := getLifecycleRules(params, obc)
+	if err != nil {
+		return nil, err
+	}
+	cfg.lifecycle = lifecycle
+
+	err = getEncryptionConfig(cfg, params, obc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = getObjectLockConfig(cfg, params, obc)
+	if err != nil {
+		return nil, err
+	}
+
+	cors, err := getCorsRules(params, obc)
+	if err != nil {
+		return nil, err
+	}
+	cfg.cors = cors
+
+	err = getAdoptConfig(cfg, params, obc)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyBucketConfig applies the configuration to the bucket.
+func (p *awsS3Provisioner) applyBucketConfig(bktName string, cfg *bucketConfig) error {
+
+	if cfg.versioning != "" {
+		glog.V(2).Infof("setting versioning of bucket %q to %q", bktName, cfg.versioning)
+		_, err := p.s3svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket: aws.String(bktName),
+			VersioningConfiguration: &s3.VersioningConfiguration{
+				Status: aws.String(cfg.versioning),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error setting versioning of bucket %q: %v", bktName, err)
+		}
+	}
+
+	if cfg.lifecycle != nil {
+		err := p.applyLifecycle(bktName, cfg.lifecycle)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.encryption != "" {
+		err := p.applyEncryption(bktName, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.denyUnencrypted != "" {
+		err := p.applyDenyUnencrypted(bktName, cfg.denyUnencrypted == "yes")
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.retention != nil {
+		err := p.applyRetention(bktName, cfg.retention)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.cors != nil {
+		err := p.applyCors(bktName, cfg.cors)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// modifyExisting returns true if the storage class allows configuring
+// existing buckets.
+func modifyExisting(params map[string]string) bool {
+	return params[scModifyExisting] == "yes"
+}
+
+// existingBucketConfig returns the part of the configuration applied to
+// existing buckets, leaving their data protection settings to their owner.
+func (cfg *bucketConfig) existingBucketConfig() *bucketConfig {
+	return &bucketConfig{cors: cfg.cors}
+}
+
+// configData returns the settings reported to clients in the OBC's
+// ConfigMap.
+func (cfg *bucketConfig) configData() map[string]string {
+
+	data := map[string]string{}
+	cfg.encryptionConfigData(data)
+	return data
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// keys in the bucket claim user secret identifying the principal
+	// granted access by the bucket policy
+	canonicalUserField = "CANONICAL_USER_ID"
+	accountIdField     = "AWS_ACCOUNT_ID"
+	// prefix of the Sid of every bucket policy statement we create
+	bucketPolicySidPrefix = "obc"
+	errNoSuchBucketPolicy = "NoSuchBucketPolicy"
+)
+
+// bucketPolicy is a resource based policy attached to a bucket.
+// Statements are kept raw so those not created by the operator are
+// written back untouched.
+type bucketPolicy struct {
+	Version   string            `json:",omitempty"`
+	Id        string            `json:",omitempty"`
+	Statement []json.RawMessage `json:",omitempty"`
+}
+
+// bucketPolicyStatement is a statement the operator adds to a bucket policy.
+type bucketPolicyStatement struct {
+	Sid       string
+	Effect    string
+	Principal interface{}
+	Action    []string `json:",omitempty"`
+	NotAction []string `json:",omitempty"`
+	Resource  []string
+	Condition map[string]map[string]string `json:",omitempty"`
+}
+
+// actions which may appear in an iam policy but are rejected in a bucket
+// policy because they don't apply to a bucket resource.
+var nonBucketActions = map[string]bool{
+	"s3:ListAllMyBuckets": true,
+	"s3:CreateBucket":     true,
+}
+
+// Get the principal secret and return it as a bucket policy principal.
+func principalFromSecret(c kubernetes.Interface, ns, name string) (map[string]string, error) {
+
+	nsName := fmt.Sprintf("%s/%s", ns, name)
+	glog.V(2).Infof("getting principal from secret %q...", nsName)
+	secret, err := c.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if id := string(secret.Data[canonicalUserField]); id != "" {
+		return map[string]string{"CanonicalUser": id}, nil
+	}
+	if id := string(secret.Data[accountIdField]); id != "" {
+		return map[string]string{"AWS": fmt.Sprintf("arn:aws:iam::%s:root", id)}, nil
+	}
+	return nil, fmt.Errorf("%s and %s are blank in secret %q", canonicalUserField, accountIdField, nsName)
+}
+
+// bucketPolicySid returns the Sid prefix of the statements granting the
+// claim access. It is derived from the claim's UID so it is unique to the
+// claim, and limited to the alphanumerics allowed in a Sid.
+func bucketPolicySid(options *apibkt.BucketOptions) string {
+	uid := string(options.ObjectBucketClaim.UID)
+	return bucketPolicySidPrefix + strings.Replace(uid, "-", "", -1)
+}
+
+// getBucketPolicy returns the bucket's policy, or an empty policy if the
+// bucket doesn't have one.
+func (p *awsS3Provisioner) getBucketPolicy(bktName string) (*bucketPolicy, error) {
+
+	policy := &bucketPolicy{}
+	out, err := p.s3svc.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bktName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errNoSuchBucketPolicy {
+			return policy, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(aws.StringValue(out.Policy)), policy)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing policy of bucket %q: %v", bktName, err)
+	}
+	return policy, nil
+}
+
+// putBucketPolicy writes the policy to the bucket, deleting the bucket
+// policy altogether if no statements are left.
+func (p *awsS3Provisioner) putBucketPolicy(bktName string, policy *bucketPolicy) error {
+
+	if len(policy.Statement) == 0 {
+		_, err := p.s3svc.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(bktName)})
+		return err
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("error marshaling bucket policy, %s", err.Error())
+	}
+	_, err = p.s3svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bktName),
+		Policy: aws.String(string(b)),
+	})
+	return err
+}
+
+// removeStatements drops the statements whose Sid starts with sid and
+// returns the number removed.
+func (b *bucketPolicy) removeStatements(sid string) int {
+
+	kept := b.Statement[:0]
+	for _, raw := range b.Statement {
+		var stmt struct{ Sid string }
+		if err := json.Unmarshal(raw, &stmt); err == nil && strings.HasPrefix(stmt.Sid, sid) {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	removed := len(b.Statement) - len(kept)
+	b.Statement = kept
+	return removed
+}
+
+// grantBucketPolicyAccess adds statements to the bucket policy granting
+// principal access to the bucket. Statements previously added for the
+// same claim are replaced, all other statements are left as they are.
+func (p *awsS3Provisioner) grantBucketPolicyAccess(bktName string, principal map[string]string, options *apibkt.BucketOptions) error {
+
+	sid := bucketPolicySid(options)
+	glog.V(2).Infof("granting access to bucket %q using bucket policy statements %q", bktName, sid)
+
+	stmts, err := grantStatements(bktName, sid, principal, options)
+	if err != nil {
+		return err
+	}
+
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		return err
+	}
+	if policy.Version == "" {
+		policy.Version = "2012-10-17"
+	}
+	policy.removeStatements(sid)
+	policy.Statement = append(policy.Statement, stmts...)
+
+	err = p.putBucketPolicy(bktName, policy)
+	if err != nil {
+		return fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+	}
+	p.bktPolicySid = sid
+
+	glog.V(2).Infof("successfully granted access to bucket %q using bucket policy", bktName)
+	return nil
+}
+
+// grantStatements returns the bucket policy statements, with Sids starting
+// with sid, granting principal the access the storage class grants claims.
+func grantStatements(bktName, sid string, principal interface{}, options *apibkt.BucketOptions) ([]json.RawMessage, error) {
+
+	stmts, err := policyStatements(bktName, options)
+	if err != nil {
+		return nil, err
+	}
+
+	raws := []json.RawMessage{}
+	for i, s := range stmts {
+		actions := []string{}
+		for _, a := range s.Action {
+			if !nonBucketActions[a] {
+				actions = append(actions, a)
+			}
+		}
+		raw, err := json.Marshal(&bucketPolicyStatement{
+			Sid:       fmt.Sprintf("%s%d", sid, i),
+			Effect:    s.Effect,
+			Principal: principal,
+			Action:    actions,
+			Resource:  s.Resource,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling bucket policy statement, %s", err.Error())
+		}
+		raws = append(raws, raw)
+	}
+	return raws, nil
+}
+
+// reconcileBucketPolicyGrant rewrites the bucket policy statements granting
+// the claim access when they no longer grant what the storage class does,
+// keeping the principal they grant it to. It returns true if they were
+// rewritten. Missing statements are reported as drift instead.
+func (p *awsS3Provisioner) reconcileBucketPolicyGrant(bktName string, options *apibkt.BucketOptions) (bool, error) {
+
+	sid := p.bktPolicySid
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		return false, fmt.Errorf("error getting policy of bucket %q: %v", bktName, err)
+	}
+	current := []grantStatement{}
+	var principal interface{}
+	for _, raw := range policy.Statement {
+		stmt, ok := parseGrantStatement(raw)
+		if ok && strings.HasPrefix(stmt.Sid, sid) {
+			current = append(current, stmt)
+			principal = stmt.Principal
+		}
+	}
+	if len(current) == 0 {
+		return false, nil
+	}
+
+	raws, err := grantStatements(bktName, sid, principal, options)
+	if err != nil {
+		return false, err
+	}
+	want := []grantStatement{}
+	for _, raw := range raws {
+		stmt, _ := parseGrantStatement(raw)
+		want = append(want, stmt)
+	}
+	for _, stmts := range [][]grantStatement{current, want} {
+		sort.Slice(stmts, func(i, j int) bool { return stmts[i].Sid < stmts[j].Sid })
+	}
+	if reflect.DeepEqual(current, want) {
+		return false, nil
+	}
+
+	glog.Infof("updating bucket policy statements %q of bucket %q", sid, bktName)
+	policy.removeStatements(sid)
+	policy.Statement = append(policy.Statement, raws...)
+	err = p.putBucketPolicy(bktName, policy)
+	if err != nil {
+		return false, fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+	}
+	return true, nil
+}
+
+// grantStatement is a bucket policy statement with its actions and
+// resources as sorted lists, however the backend returns them.
+type grantStatement struct {
+	Sid       string
+	Effect    string
+	Principal interface{}
+	Action    []string
+	Resource  []string
+}
+
+func parseGrantStatement(raw json.RawMessage) (grantStatement, bool) {
+
+	var stmt struct {
+		Sid       string
+		Effect    string
+		Principal interface{}
+		Action    interface{}
+		Resource  interface{}
+	}
+	if err := json.Unmarshal(raw, &stmt); err != nil {
+		return grantStatement{}, false
+	}
+	return grantStatement{
+		Sid:       stmt.Sid,
+		Effect:    stmt.Effect,
+		Principal: stmt.Principal,
+		Action:    stringList(stmt.Action),
+		Resource:  stringList(stmt.Resource),
+	}, true
+}
+
+// stringList returns a policy element, a string or a list of strings, as a
+// sorted list.
+func stringList(v interface{}) []string {
+
+	list := []string{}
+	switch v := v.(type) {
+	case string:
+		list = append(list, v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// revokeBucketPolicyAccess removes the statements added to the bucket
+// policy by grantBucketPolicyAccess.
+func (p *awsS3Provisioner) revokeBucketPolicyAccess(bktName string) error {
+
+	sid := p.bktPolicySid
+	glog.V(2).Infof("revoking bucket policy statements %q from bucket %q", sid, bktName)
+
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		if isNoSuchBucketError(err) {
+			return nil
+		}
+		return err
+	}
+	if policy.removeStatements(sid) == 0 {
+		glog.V(2).Infof("no bucket policy statements %q found on bucket %q", sid, bktName)
+		return nil
+	}
+
+	err = p.putBucketPolicy(bktName, policy)
+	if err != nil {
+		return fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+	}
+
+	glog.V(2).Infof("successfully revoked bucket policy statements %q from bucket %q", sid, bktName)
+	return nil
+}
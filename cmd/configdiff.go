@@ -0,0 +1,354 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+)
+
+const (
+	// error codes of bucket configurations which aren't set
+	errNoSuchLifecycleConfig = "NoSuchLifecycleConfiguration"
+	errNoEncryptionConfig    = "ServerSideEncryptionConfigurationNotFoundError"
+	errNoSuchCORSConfig      = "NoSuchCORSConfiguration"
+	// IAM keeps at most this many versions of a managed policy
+	maxPolicyVersions = 5
+)
+
+// isAWSErrorCode returns true if err is an aws error with one of the codes.
+func isAWSErrorCode(err error, codes ...string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		for _, code := range codes {
+			if aerr.Code() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bucketConfigDiff returns the part of cfg which differs from the bucket's
+// current configuration, nil if none does. Settings which can't be read
+// from the backend are assumed to differ, and are applied again. When cfg
+// is exclusive, settings the bucket has but cfg lacks are removed by the
+// diff.
+func (p *awsS3Provisioner) bucketConfigDiff(bktName string, cfg *bucketConfig) (*bucketConfig, error) {
+
+	diff := &bucketConfig{}
+	changed := false
+
+	if cfg.versioning != "" {
+		out, err := p.s3svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bktName)})
+		if err != nil && isNoSuchBucketError(err) {
+			return nil, err
+		}
+		if err != nil || aws.StringValue(out.Status) != cfg.versioning {
+			diff.versioning = cfg.versioning
+			changed = true
+		}
+	}
+
+	lifecycle := cfg.lifecycle
+	if lifecycle == nil && cfg.exclusive {
+		lifecycle = []*s3.LifecycleRule{}
+	}
+	if lifecycle != nil {
+		var rules []*s3.LifecycleRule
+		unknown := false
+		out, err := p.s3svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bktName)})
+		switch {
+		case err == nil:
+			rules = out.Rules
+		case !isAWSErrorCode(err, errNoSuchLifecycleConfig):
+			glog.V(2).Infof("unable to get lifecycle rules of bucket %q: %v", bktName, err)
+			unknown = true
+		}
+		if unknown || !reflect.DeepEqual(lifecycleRuleKeys(rules), lifecycleRuleKeys(lifecycle)) {
+			diff.lifecycle = lifecycle
+			changed = true
+		}
+	}
+
+	if cfg.encryption != "" || cfg.exclusive {
+		var current *s3.ServerSideEncryptionByDefault
+		out, err := p.s3svc.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String(bktName)})
+		if err == nil && out.ServerSideEncryptionConfiguration != nil && len(out.ServerSideEncryptionConfiguration.Rules) > 0 {
+			current = out.ServerSideEncryptionConfiguration.Rules[0].ApplyServerSideEncryptionByDefault
+		}
+		unknown := err != nil && !isAWSErrorCode(err, errNoEncryptionConfig)
+		if unknown {
+			glog.V(2).Infof("unable to get default encryption of bucket %q: %v", bktName, err)
+		}
+		switch {
+		case cfg.encryption == "":
+			if current != nil || unknown {
+				diff.encryption = encryptionNone
+				changed = true
+			}
+		case !encryptionMatches(current, cfg):
+			diff.encryption = cfg.encryption
+			diff.kmsKeyID = cfg.kmsKeyID
+			changed = true
+		}
+	}
+
+	denyUnencrypted := cfg.denyUnencrypted
+	if denyUnencrypted == "" && cfg.exclusive {
+		denyUnencrypted = "no"
+	}
+	if denyUnencrypted != "" {
+		policy, err := p.getBucketPolicy(bktName)
+		if err != nil || (policy.removeStatements(denyUnencryptedSid) > 0) != (denyUnencrypted == "yes") {
+			diff.denyUnencrypted = denyUnencrypted
+			changed = true
+		}
+	}
+
+	if cfg.retention != nil {
+		out, err := p.s3svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: aws.String(bktName)})
+		if err != nil || out.ObjectLockConfiguration == nil || out.ObjectLockConfiguration.Rule == nil ||
+			!reflect.DeepEqual(out.ObjectLockConfiguration.Rule.DefaultRetention, cfg.retention) {
+			diff.retention = cfg.retention
+			changed = true
+		}
+	}
+
+	cors := cfg.cors
+	if cors == nil && cfg.exclusive {
+		cors = []*s3.CORSRule{}
+	}
+	if cors != nil {
+		var rules []*s3.CORSRule
+		unknown := false
+		out, err := p.s3svc.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(bktName)})
+		switch {
+		case err == nil:
+			rules = out.CORSRules
+		case !isAWSErrorCode(err, errNoSuchCORSConfig):
+			glog.V(2).Infof("unable to get CORS rules of bucket %q: %v", bktName, err)
+			unknown = true
+		}
+		if unknown || !reflect.DeepEqual(corsRuleKeys(rules), corsRuleKeys(cors)) {
+			diff.cors = cors
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return diff, nil
+}
+
+// lifecycleRuleKeys returns the rules normalised the way the backend
+// returns them, in a form which can be compared regardless of their order.
+// IDs, which the backend generates when they're missing, aren't compared.
+func lifecycleRuleKeys(rules []*s3.LifecycleRule) []string {
+
+	keys := []string{}
+	for _, rule := range rules {
+		r := &s3.LifecycleRule{}
+		copyJSON(rule, r)
+		r.ID = nil
+		if r.Filter == nil {
+			r.Filter = &s3.LifecycleRuleFilter{Prefix: r.Prefix}
+			r.Prefix = nil
+		}
+		if r.Filter.Prefix == nil && r.Filter.And == nil && r.Filter.Tag == nil {
+			r.Filter.Prefix = aws.String("")
+		}
+		if len(r.Transitions) == 0 {
+			r.Transitions = nil
+		}
+		if len(r.NoncurrentVersionTransitions) == 0 {
+			r.NoncurrentVersionTransitions = nil
+		}
+		if r.Expiration != nil && !aws.BoolValue(r.Expiration.ExpiredObjectDeleteMarker) {
+			r.Expiration.ExpiredObjectDeleteMarker = nil
+		}
+		keys = append(keys, jsonKey(r))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// corsRuleKeys returns the rules normalised the way the backend returns
+// them, in a form which can be compared regardless of the order of the
+// rules and of their lists.
+func corsRuleKeys(rules []*s3.CORSRule) []string {
+
+	keys := []string{}
+	for _, rule := range rules {
+		r := &s3.CORSRule{}
+		copyJSON(rule, r)
+		for _, list := range []*[]*string{&r.AllowedHeaders, &r.AllowedMethods, &r.AllowedOrigins, &r.ExposeHeaders} {
+			values := aws.StringValueSlice(*list)
+			sort.Strings(values)
+			*list = nil
+			if len(values) > 0 {
+				*list = aws.StringSlice(values)
+			}
+		}
+		if aws.Int64Value(r.MaxAgeSeconds) == 0 {
+			r.MaxAgeSeconds = nil
+		}
+		keys = append(keys, jsonKey(r))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyJSON deep copies the aws type from into to.
+func copyJSON(from, to interface{}) {
+	b, _ := json.Marshal(from)
+	json.Unmarshal(b, to)
+}
+
+// jsonKey returns the JSON encoding of an aws type, for comparisons.
+func jsonKey(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// encryptionMatches returns true if the bucket's default encryption is the
+// one configured in cfg.
+func encryptionMatches(current *s3.ServerSideEncryptionByDefault, cfg *bucketConfig) bool {
+
+	if current == nil {
+		return false
+	}
+	if cfg.encryption == encryptionSSEKMS {
+		return aws.StringValue(current.SSEAlgorithm) == s3.ServerSideEncryptionAwsKms &&
+			aws.StringValue(current.KMSMasterKeyID) == cfg.kmsKeyID
+	}
+	return aws.StringValue(current.SSEAlgorithm) == s3.ServerSideEncryptionAes256
+}
+
+// reconcileUserPolicy makes the document of the claim user's managed policy
+// the one the storage class currently grants, adding a new default version
+// of the policy if they differ, or, for access granted by the bucket
+// policy, its statements. It returns true if the policy was changed.
+func (p *awsS3Provisioner) reconcileUserPolicy(bktName string, options *apibkt.BucketOptions) (bool, error) {
+
+	if p.policyMode() == policyModeBucketPolicy {
+		return p.reconcileBucketPolicyGrant(bktName, options)
+	}
+	if p.policyMode() != policyModeManaged || p.bktUserPolicyArn == "" {
+		return false, nil
+	}
+	arn := p.bktUserPolicyArn
+
+	want, err := p.createBucketPolicyDocument(bktName, options)
+	if err != nil {
+		return false, err
+	}
+	// createBucketPolicyDocument records the bucket's ARN as the policy's
+	p.bktUserPolicyArn = arn
+
+	current, err := p.getPolicyDocument(arn)
+	if err != nil {
+		return false, err
+	}
+	same, err := samePolicyDocuments(current, want)
+	if err != nil || same {
+		return false, err
+	}
+
+	glog.Infof("updating policy %q of user %q for bucket %q", arn, p.bktUserName, bktName)
+	versions, err := p.iamsvc.ListPolicyVersions(&awsuser.ListPolicyVersionsInput{PolicyArn: aws.String(arn)})
+	if err != nil {
+		return false, fmt.Errorf("error listing versions of policy %q: %v", arn, err)
+	}
+	// make room for the new version by deleting the oldest one
+	if len(versions.Versions) >= maxPolicyVersions {
+		var oldest *awsuser.PolicyVersion
+		for _, v := range versions.Versions {
+			if aws.BoolValue(v.IsDefaultVersion) {
+				continue
+			}
+			if oldest == nil || aws.TimeValue(v.CreateDate).Before(aws.TimeValue(oldest.CreateDate)) {
+				oldest = v
+			}
+		}
+		if oldest != nil {
+			_, err = p.iamsvc.DeletePolicyVersion(&awsuser.DeletePolicyVersionInput{
+				PolicyArn: aws.String(arn),
+				VersionId: oldest.VersionId,
+			})
+			if err != nil {
+				return false, fmt.Errorf("error deleting version %s of policy %q: %v", aws.StringValue(oldest.VersionId), arn, err)
+			}
+		}
+	}
+	_, err = p.iamsvc.CreatePolicyVersion(&awsuser.CreatePolicyVersionInput{
+		PolicyArn:      aws.String(arn),
+		PolicyDocument: aws.String(want),
+		SetAsDefault:   aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error updating policy %q: %v", arn, err)
+	}
+	return true, nil
+}
+
+// getPolicyDocument returns the document of the managed policy's default
+// version.
+func (p *awsS3Provisioner) getPolicyDocument(arn string) (string, error) {
+
+	policy, err := p.iamsvc.GetPolicy(&awsuser.GetPolicyInput{PolicyArn: aws.String(arn)})
+	if err != nil {
+		return "", fmt.Errorf("error getting policy %q: %v", arn, err)
+	}
+	version, err := p.iamsvc.GetPolicyVersion(&awsuser.GetPolicyVersionInput{
+		PolicyArn: aws.String(arn),
+		VersionId: policy.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting version %s of policy %q: %v", aws.StringValue(policy.Policy.DefaultVersionId), arn, err)
+	}
+	// IAM returns the document URL encoded
+	doc, err := url.QueryUnescape(aws.StringValue(version.PolicyVersion.Document))
+	if err != nil {
+		return "", fmt.Errorf("error decoding policy %q: %v", arn, err)
+	}
+	return doc, nil
+}
+
+// samePolicyDocuments returns true if both documents grant the same
+// permissions, regardless of their formatting.
+func samePolicyDocuments(a, b string) (bool, error) {
+
+	var docA, docB PolicyDocument
+	if err := json.Unmarshal([]byte(a), &docA); err != nil {
+		return false, fmt.Errorf("error parsing policy document: %v", err)
+	}
+	if err := json.Unmarshal([]byte(b), &docB); err != nil {
+		return false, fmt.Errorf("error parsing policy document: %v", err)
+	}
+	return reflect.DeepEqual(docA, docB), nil
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+)
+
+func TestBucketConfigDiff(t *testing.T) {
+
+	// rules as configured in a storage class
+	expire := []*s3.LifecycleRule{
+		{
+			Prefix:     aws.String(""),
+			Status:     aws.String("Enabled"),
+			Expiration: &s3.LifecycleExpiration{Days: aws.Int64(30)},
+		},
+		{
+			Prefix: aws.String("tmp/"),
+			Status: aws.String("Enabled"),
+			AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int64(7),
+			},
+		},
+	}
+	cors := []*s3.CORSRule{{
+		AllowedMethods: aws.StringSlice([]string{"PUT", "GET"}),
+		AllowedOrigins: aws.StringSlice([]string{"https://b.example.com", "https://a.example.com"}),
+		ExposeHeaders:  []*string{},
+		MaxAgeSeconds:  aws.Int64(0),
+	}}
+
+	// the same rules as returned by the backend
+	expireStored := []*s3.LifecycleRule{
+		{
+			ID:     aws.String("generated-2"),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("tmp/")},
+			Status: aws.String("Enabled"),
+			AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int64(7),
+			},
+			Transitions: []*s3.Transition{},
+		},
+		{
+			ID:     aws.String("generated-1"),
+			Filter: &s3.LifecycleRuleFilter{},
+			Status: aws.String("Enabled"),
+			Expiration: &s3.LifecycleExpiration{
+				Days:                      aws.Int64(30),
+				ExpiredObjectDeleteMarker: aws.Bool(false),
+			},
+		},
+	}
+	corsStored := []*s3.CORSRule{{
+		AllowedMethods: aws.StringSlice([]string{"GET", "PUT"}),
+		AllowedOrigins: aws.StringSlice([]string{"https://a.example.com", "https://b.example.com"}),
+	}}
+	corsOther := []*s3.CORSRule{{
+		AllowedMethods: aws.StringSlice([]string{"GET"}),
+		AllowedOrigins: aws.StringSlice([]string{"*"}),
+	}}
+	aes := &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{{
+		ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+			SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+		},
+	}}}
+
+	denyPolicy := aws.String(`{"Version":"2012-10-17","Statement":[{"Sid":"` + denyUnencryptedSid + `","Effect":"Deny"}]}`)
+	otherPolicy := aws.String(`{"Version":"2012-10-17","Statement":[{"Sid":"other","Effect":"Allow"}]}`)
+
+	tests := []struct {
+		name     string
+		s3       *fakeS3
+		cfg      *bucketConfig
+		wantDiff *bucketConfig
+		wantErr  bool
+	}{
+		{"nothing configured", &fakeS3{}, &bucketConfig{}, nil, false},
+		{
+			"in sync once normalised",
+			&fakeS3{versioning: aws.String("Enabled"), lifecycle: expireStored, cors: corsStored, encryption: aes},
+			&bucketConfig{versioning: "Enabled", lifecycle: expire, cors: cors, encryption: encryptionSSES3},
+			nil, false,
+		},
+		{
+			"versioning changed",
+			&fakeS3{versioning: aws.String("Suspended"), lifecycle: expireStored},
+			&bucketConfig{versioning: "Enabled", lifecycle: expire},
+			&bucketConfig{versioning: "Enabled"}, false,
+		},
+		{
+			"versioning never set",
+			&fakeS3{},
+			&bucketConfig{versioning: "Suspended"},
+			&bucketConfig{versioning: "Suspended"}, false,
+		},
+		{
+			"lifecycle rule removed",
+			&fakeS3{lifecycle: expireStored[:1]},
+			&bucketConfig{lifecycle: expire},
+			&bucketConfig{lifecycle: expire}, false,
+		},
+		{
+			"no lifecycle rules",
+			&fakeS3{},
+			&bucketConfig{lifecycle: expire},
+			&bucketConfig{lifecycle: expire}, false,
+		},
+		{
+			"CORS rules changed",
+			&fakeS3{cors: corsOther},
+			&bucketConfig{cors: cors},
+			&bucketConfig{cors: cors}, false,
+		},
+		{
+			"CORS rules removed as configured",
+			&fakeS3{},
+			&bucketConfig{cors: []*s3.CORSRule{}},
+			nil, false,
+		},
+		{
+			"CORS rules to remove",
+			&fakeS3{cors: corsStored},
+			&bucketConfig{cors: []*s3.CORSRule{}},
+			&bucketConfig{cors: []*s3.CORSRule{}}, false,
+		},
+		{
+			"encryption disabled",
+			&fakeS3{},
+			&bucketConfig{encryption: encryptionSSEKMS, kmsKeyID: "key"},
+			&bucketConfig{encryption: encryptionSSEKMS, kmsKeyID: "key"}, false,
+		},
+		{
+			"unset settings left alone",
+			&fakeS3{lifecycle: expireStored, cors: corsStored, encryption: aes, policy: denyPolicy},
+			&bucketConfig{},
+			nil, false,
+		},
+		{
+			"exclusive without settings",
+			&fakeS3{policy: otherPolicy},
+			&bucketConfig{exclusive: true},
+			nil, false,
+		},
+		{
+			"exclusive and in sync",
+			&fakeS3{lifecycle: expireStored, cors: corsStored, encryption: aes, policy: denyPolicy},
+			&bucketConfig{lifecycle: expire, cors: cors, encryption: encryptionSSES3, denyUnencrypted: "yes", exclusive: true},
+			nil, false,
+		},
+		{
+			"lifecycle removed from the config",
+			&fakeS3{lifecycle: expireStored},
+			&bucketConfig{exclusive: true},
+			&bucketConfig{lifecycle: []*s3.LifecycleRule{}}, false,
+		},
+		{
+			"CORS removed from the config",
+			&fakeS3{cors: corsStored},
+			&bucketConfig{lifecycle: expire, exclusive: true},
+			&bucketConfig{lifecycle: expire, cors: []*s3.CORSRule{}}, false,
+		},
+		{
+			"encryption removed from the config",
+			&fakeS3{encryption: aes},
+			&bucketConfig{exclusive: true},
+			&bucketConfig{encryption: encryptionNone}, false,
+		},
+		{
+			"deny statement removed from the config",
+			&fakeS3{policy: denyPolicy},
+			&bucketConfig{exclusive: true},
+			&bucketConfig{denyUnencrypted: "no"}, false,
+		},
+		{
+			"bucket deleted",
+			&fakeS3{noBucket: true},
+			&bucketConfig{versioning: "Enabled"},
+			nil, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsS3Provisioner{s3svc: tt.s3}
+			diff, err := p.bucketConfigDiff("bkt", tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bucketConfigDiff() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(diff, tt.wantDiff) {
+				t.Errorf("bucketConfigDiff() = %+v, want %+v", diff, tt.wantDiff)
+			}
+		})
+	}
+}
+
+func TestReconcileBucketPolicyGrant(t *testing.T) {
+
+	const (
+		sid   = "obcuid1"
+		other = `{"Sid":"other","Effect":"Allow","Principal":"*","Action":"s3:GetObject","Resource":"arn:aws:s3:::bkt/public/*"}`
+		// the claim's statement, as the backend returns it
+		grant = `{"Sid":"obcuid10","Effect":"Allow","Principal":{"AWS":"arn:aws:iam::111122223333:root"},` +
+			`"Action":"s3:GetObject","Resource":["arn:aws:s3:::bkt","arn:aws:s3:::bkt/*"]}`
+		readPolicy      = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:GetObject"]}]}`
+		readWritePolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:GetObject","s3:PutObject"]}]}`
+	)
+	policy := func(stmts ...string) *string {
+		return aws.String(`{"Version":"2012-10-17","Statement":[` + strings.Join(stmts, ",") + `]}`)
+	}
+
+	tests := []struct {
+		name      string
+		policy    *string
+		iamPolicy string
+		want      bool
+		// substrings of the bucket policy once done
+		wantPolicy []string
+	}{
+		{"in sync", policy(other, grant), readPolicy, false, []string{`"Sid":"other"`, `"Action":"s3:GetObject"`}},
+		{
+			"iamPolicy changed", policy(other, grant), readWritePolicy, true,
+			[]string{`"Sid":"other"`, `"Sid":"obcuid10"`, `"s3:PutObject"`, `"AWS":"arn:aws:iam::111122223333:root"`},
+		},
+		{"statements missing", policy(other), readWritePolicy, false, []string{`"Sid":"other"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3{policy: tt.policy}
+			p := &awsS3Provisioner{s3svc: f, bktPolicySid: sid}
+			options := &apibkt.BucketOptions{
+				ObjectBucketClaim: &v1alpha1.ObjectBucketClaim{},
+				Parameters:        map[string]string{"iamPolicy": tt.iamPolicy},
+			}
+			changed, err := p.reconcileUserPolicy("bkt", options)
+			if err != nil {
+				t.Fatalf("reconcileUserPolicy() error = %v", err)
+			}
+			if changed != tt.want {
+				t.Errorf("reconcileUserPolicy() = %v, want %v", changed, tt.want)
+			}
+			for _, want := range tt.wantPolicy {
+				if !strings.Contains(aws.StringValue(f.policy), want) {
+					t.Errorf("bucket policy %s, want it to contain %s", aws.StringValue(f.policy), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// CORS rule list, in JSON or YAML, using the field names of the S3
+	// CORSRule type
+	cfgCors = "cors"
+	// comma separated origins replacing those of every CORS rule
+	cfgCorsAllowedOrigins = "corsAllowedOrigins"
+	// max age of the default rule added when only origins are configured
+	defaultCorsMaxAge = 3000
+)
+
+// getCorsRules returns the CORS rules from the storage class parameters and
+// the OBC, or nil if none are configured. An empty list removes the bucket's
+// CORS configuration.
+func getCorsRules(params map[string]string, obc *v1alpha1.ObjectBucketClaim) ([]*s3.CORSRule, error) {
+
+	var rules []*s3.CORSRule
+	if v := configValue(params, obc, cfgCors); v != "" {
+		b, err := yaml.YAMLToJSON([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", cfgCors, err)
+		}
+		err = json.Unmarshal(b, &rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", cfgCors, err)
+		}
+	}
+
+	if v := configValue(params, obc, cfgCorsAllowedOrigins); v != "" {
+		var origins []*string
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, aws.String(origin))
+			}
+		}
+		if len(origins) == 0 {
+			return nil, fmt.Errorf("invalid %s %q, must list at least one origin", cfgCorsAllowedOrigins, v)
+		}
+		// without rules, allow browsers to read objects from the origins
+		if len(rules) == 0 {
+			rules = []*s3.CORSRule{{
+				AllowedMethods: aws.StringSlice([]string{"GET", "HEAD"}),
+				AllowedHeaders: aws.StringSlice([]string{"*"}),
+				MaxAgeSeconds:  aws.Int64(defaultCorsMaxAge),
+			}}
+		}
+		for _, rule := range rules {
+			rule.AllowedOrigins = origins
+		}
+	}
+
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid CORS rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// applyCors replaces the bucket's CORS configuration with rules, or deletes
+// it if there are none.
+func (p *awsS3Provisioner) applyCors(bktName string, rules []*s3.CORSRule) error {
+
+	if len(rules) == 0 {
+		glog.V(2).Infof("removing CORS rules of bucket %q", bktName)
+		_, err := p.s3svc.DeleteBucketCors(&s3.DeleteBucketCorsInput{Bucket: aws.String(bktName)})
+		if err != nil {
+			return fmt.Errorf("error removing CORS rules of bucket %q: %v", bktName, err)
+		}
+		return nil
+	}
+
+	glog.V(2).Infof("setting %d CORS rules on bucket %q", len(rules), bktName)
+	_, err := p.s3svc.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket:            aws.String(bktName),
+		CORSConfiguration: &s3.CORSConfiguration{CORSRules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting CORS rules of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned"
+)
+
+const (
+	// OB annotation holding the checkpointed progress of a bucket deletion
+	annotationDeletion = "cloudian-s3.io/deletion-progress"
+)
+
+// deletionJob is a bucket deletion running in the background.
+type deletionJob struct {
+	sync.Mutex
+	progress purgeProgress
+	done     bool
+	err      error
+}
+
+// bucketDeleter runs the deletion of buckets in the background, so a large
+// bucket doesn't block a controller worker. The bucket library retries
+// Delete, which reports the progress until the bucket is gone, and only
+// then removes the OB's finalizer.
+type bucketDeleter struct {
+	sync.Mutex
+	libClientset versioned.Interface
+	// running and finished jobs by OB name
+	jobs map[string]*deletionJob
+}
+
+func newBucketDeleter(libClientset versioned.Interface) *bucketDeleter {
+	return &bucketDeleter{
+		libClientset: libClientset,
+		jobs:         map[string]*deletionJob{},
+	}
+}
+
+// started returns true if the deletion of the OB's bucket was started,
+// possibly before a restart.
+func (d *bucketDeleter) started(ob *v1alpha1.ObjectBucket) bool {
+	_, ok := ob.Annotations[annotationDeletion]
+	return ok
+}
+
+// deleteBucket starts or resumes the deletion of the OB's bucket in the
+// background using the provisioner p, whose services are set up for the
+// OB. It returns nil once the bucket is deleted, and an error reporting
+// the progress or failure until then.
+func (d *bucketDeleter) deleteBucket(p awsS3Provisioner, ob *v1alpha1.ObjectBucket) error {
+
+	d.Lock()
+	defer d.Unlock()
+
+	if job, ok := d.jobs[ob.Name]; ok {
+		job.Lock()
+		defer job.Unlock()
+		if !job.done {
+			return fmt.Errorf("deleting bucket %q in the background: %d objects deleted so far",
+				p.bucketName, job.progress.Deleted)
+		}
+		// failed jobs are restarted from their checkpoint by the next retry
+		delete(d.jobs, ob.Name)
+		if job.err != nil {
+			return fmt.Errorf("error deleting bucket %q: %v", p.bucketName, job.err)
+		}
+		glog.Infof("Deleted bucket %q from OB %q", p.bucketName, ob.Name)
+		return nil
+	}
+
+	job := &deletionJob{}
+	if v, ok := ob.Annotations[annotationDeletion]; ok {
+		if err := json.Unmarshal([]byte(v), &job.progress); err != nil {
+			glog.Errorf("ignoring invalid %s annotation of OB %q: %v", annotationDeletion, ob.Name, err)
+		} else {
+			glog.Infof("Resuming deletion of bucket %q for OB %q after %d objects", p.bucketName, ob.Name, job.progress.Deleted)
+		}
+	}
+
+	// record the start before returning, so a restart knows credentials
+	// were already removed
+	err := d.checkpoint(ob.Name, &job.progress)
+	if err != nil {
+		return err
+	}
+
+	d.jobs[ob.Name] = job
+	go d.run(p, ob.Name, job)
+	return fmt.Errorf("started deleting bucket %q in the background", p.bucketName)
+}
+
+// run purges the bucket, checkpointing the progress in the OB.
+func (d *bucketDeleter) run(p awsS3Provisioner, obName string, job *deletionJob) {
+
+	job.Lock()
+	progress := job.progress
+	job.Unlock()
+
+	err := p.purgeBucketFrom(p.bucketName, &progress, func(pp *purgeProgress) error {
+		job.Lock()
+		job.progress = progress
+		job.Unlock()
+		// a failed checkpoint only means resuming from an earlier one
+		if err := d.checkpoint(obName, &progress); err != nil {
+			glog.Errorf("unable to checkpoint deletion of bucket %q: %v", p.bucketName, err)
+		}
+		return nil
+	})
+
+	job.Lock()
+	job.progress = progress
+	job.done = true
+	job.err = err
+	job.Unlock()
+	if err != nil {
+		glog.Errorf("error deleting bucket %q for OB %q: %v", p.bucketName, obName, err)
+	}
+}
+
+// checkpoint records the progress in the OB's annotation.
+func (d *bucketDeleter) checkpoint(obName string, progress *purgeProgress) error {
+
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return setOBAnnotation(d.libClientset, obName, annotationDeletion, string(b))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	libfake "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runDeletionJob starts or resumes the deletion of the OB's bucket and
+// returns its outcome once the job is done.
+func runDeletionJob(t *testing.T, d *bucketDeleter, p awsS3Provisioner, ob *v1alpha1.ObjectBucket) error {
+
+	if err := d.deleteBucket(p, ob); err == nil {
+		t.Fatalf("deleteBucket() = nil, want the job started")
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		d.Lock()
+		job := d.jobs[ob.Name]
+		d.Unlock()
+		job.Lock()
+		done := job.done
+		job.Unlock()
+		if done {
+			return d.deleteBucket(p, ob)
+		}
+	}
+	t.Fatalf("deletion of bucket %q didn't finish", p.bucketName)
+	return nil
+}
+
+func TestBucketDeleterResume(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		objects  []fakeObject
+		failKeys map[string]bool
+		// progress checkpointed before a restart, none if empty
+		progress string
+		// outcome of the first job, and the progress it checkpoints
+		wantFirstErr   bool
+		wantCheckpoint purgeProgress
+		// listings of all the jobs, by their key marker
+		wantLists []string
+	}{
+		{
+			name:           "new deletion",
+			objects:        fakeObjects("a", "b", "c", "d", "e"),
+			wantCheckpoint: purgeProgress{Deleted: 5},
+			wantLists:      []string{"", "b", "d"},
+		},
+		{
+			name:           "resumed from the checkpoint",
+			objects:        fakeObjects("c", "d", "e"),
+			progress:       `{"keyMarker":"b","versionIdMarker":"v1","deleted":2}`,
+			wantCheckpoint: purgeProgress{Deleted: 5},
+			wantLists:      []string{"b", "d"},
+		},
+		{
+			name:           "invalid checkpoint",
+			objects:        fakeObjects("a"),
+			progress:       "{",
+			wantCheckpoint: purgeProgress{Deleted: 1},
+			wantLists:      []string{""},
+		},
+		{
+			// the bucket isn't empty once the pass is over
+			name:           "resumed after objects were written behind the marker",
+			objects:        fakeObjects("a", "c", "d"),
+			progress:       `{"keyMarker":"b","versionIdMarker":"v1","deleted":2}`,
+			wantFirstErr:   true,
+			wantCheckpoint: purgeProgress{Deleted: 4},
+			wantLists:      []string{"b", ""},
+		},
+		{
+			name:           "resumed after objects failed to delete",
+			objects:        fakeObjects("a", "b", "c", "d", "e"),
+			failKeys:       map[string]bool{"c": true},
+			wantFirstErr:   true,
+			wantCheckpoint: purgeProgress{Deleted: 3},
+			wantLists:      []string{"", "b", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ob := &v1alpha1.ObjectBucket{ObjectMeta: metav1.ObjectMeta{Name: "obc-ns-claim"}}
+			if tt.progress != "" {
+				ob.Annotations = map[string]string{annotationDeletion: tt.progress}
+			}
+			lib := libfake.NewSimpleClientset(ob)
+			f := &fakeS3{objects: tt.objects, failKeys: tt.failKeys, pageSize: 2}
+			p := awsS3Provisioner{bucketName: "bkt", s3svc: f}
+			d := newBucketDeleter(lib)
+
+			checkpointed := func() *v1alpha1.ObjectBucket {
+				t.Helper()
+				ob, err := lib.ObjectbucketV1alpha1().ObjectBuckets().Get(ob.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("getting OB: %v", err)
+				}
+				if !d.started(ob) {
+					t.Fatalf("OB has no %s annotation", annotationDeletion)
+				}
+				return ob
+			}
+
+			err := runDeletionJob(t, d, p, ob)
+			if (err != nil) != tt.wantFirstErr {
+				t.Fatalf("deleteBucket() error = %v, want error %v", err, tt.wantFirstErr)
+			}
+			progress := purgeProgress{}
+			if err := json.Unmarshal([]byte(checkpointed().Annotations[annotationDeletion]), &progress); err != nil {
+				t.Fatalf("invalid checkpoint: %v", err)
+			}
+			if progress != tt.wantCheckpoint {
+				t.Errorf("checkpoint = %+v, want %+v", progress, tt.wantCheckpoint)
+			}
+
+			// the bucket library retries with the checkpointed OB
+			if tt.wantFirstErr {
+				f.failKeys = nil
+				err = runDeletionJob(t, d, p, checkpointed())
+				if err != nil {
+					t.Fatalf("deleteBucket() of the retry error = %v", err)
+				}
+			}
+			if !f.noBucket || len(f.objects) > 0 {
+				t.Errorf("bucket not deleted, objects left %v", f.objects)
+			}
+			lists := []string{}
+			for _, call := range f.calls {
+				if strings.HasPrefix(call, "ListObjectVersions ") {
+					lists = append(lists, strings.TrimPrefix(call, "ListObjectVersions "))
+				}
+			}
+			if !reflect.DeepEqual(lists, tt.wantLists) {
+				t.Errorf("listed from %q, want %q", lists, tt.wantLists)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// storage class parameter allowing the reconciler to recreate a
+	// claim's missing IAM user, policy or access key
+	scRepairDrift = "repairDrift"
+	// OB annotation listing the drift found on the backend, empty if none
+	annotationDrift = "cloudian-s3.io/drift"
+	// HeadBucket reports a missing bucket without an error body
+	errCodeNotFound = "NotFound"
+)
+
+// driftReport is what the backend lacks of what was recorded in the OB.
+type driftReport struct {
+	bucketMissing       bool
+	userMissing         bool
+	policyMissing       bool
+	policyDetached      bool
+	keysInvalid         bool
+	bucketPolicyMissing bool
+}
+
+// findings describes the drift, one entry per problem found.
+func (d *driftReport) findings(p *awsS3Provisioner) []string {
+
+	findings := []string{}
+	if d.bucketMissing {
+		findings = append(findings, fmt.Sprintf("bucket %q no longer exists", p.bucketName))
+	}
+	if d.userMissing {
+		findings = append(findings, fmt.Sprintf("IAM user %q no longer exists", p.bktUserName))
+	}
+	if d.policyMissing {
+		findings = append(findings, fmt.Sprintf("IAM policy %q no longer exists", p.bktUserPolicyArn))
+	}
+	if d.policyDetached && !d.userMissing && !d.policyMissing {
+		findings = append(findings, fmt.Sprintf("IAM policy %q is not attached to user %q", p.bktUserPolicyArn, p.bktUserName))
+	}
+	if d.keysInvalid && !d.userMissing {
+		findings = append(findings, fmt.Sprintf("access key %q of user %q is missing or inactive", p.bktUserAccessId, p.bktUserName))
+	}
+	if d.bucketPolicyMissing {
+		findings = append(findings, fmt.Sprintf("bucket policy statements %q are missing from bucket %q", p.bktPolicySid, p.bucketName))
+	}
+	return findings
+}
+
+// detectDrift checks the bucket, user, access keys and policy recorded in
+// the OB still exist on the backend, and that the policy still grants the
+// claim access.
+func (p *awsS3Provisioner) detectDrift() (*driftReport, error) {
+
+	d := &driftReport{}
+	_, err := p.s3svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(p.bucketName)})
+	if err != nil {
+		if !isAWSErrorCode(err, s3.ErrCodeNoSuchBucket, errCodeNotFound) {
+			return nil, fmt.Errorf("error checking bucket %q exists: %v", p.bucketName, err)
+		}
+		d.bucketMissing = true
+	}
+
+	switch p.policyMode() {
+	case policyModeBucketPolicy:
+		if d.bucketMissing {
+			break
+		}
+		policy, err := p.getBucketPolicy(p.bucketName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting policy of bucket %q: %v", p.bucketName, err)
+		}
+		d.bucketPolicyMissing = policy.removeStatements(p.bktPolicySid) == 0
+
+	case policyModeManaged:
+		exists, err := p.checkIfUserExists(p.bktUserName)
+		if err != nil {
+			return nil, err
+		}
+		d.userMissing = !exists
+
+		if p.bktUserPolicyArn != "" {
+			_, err = p.iamsvc.GetPolicy(&awsuser.GetPolicyInput{PolicyArn: aws.String(p.bktUserPolicyArn)})
+			if err != nil && !isNoSuchEntityError(err) {
+				return nil, fmt.Errorf("error getting policy %q: %v", p.bktUserPolicyArn, err)
+			}
+			d.policyMissing = err != nil
+		}
+		if d.userMissing {
+			d.policyDetached = true
+			d.keysInvalid = true
+			break
+		}
+
+		attached, err := p.iamsvc.ListAttachedUserPolicies(&awsuser.ListAttachedUserPoliciesInput{UserName: aws.String(p.bktUserName)})
+		if err != nil {
+			return nil, fmt.Errorf("error listing policies of user %q: %v", p.bktUserName, err)
+		}
+		d.policyDetached = p.bktUserPolicyArn != ""
+		for _, ap := range attached.AttachedPolicies {
+			if aws.StringValue(ap.PolicyArn) == p.bktUserPolicyArn {
+				d.policyDetached = false
+			}
+		}
+
+		keys, err := p.iamsvc.ListAccessKeys(&awsuser.ListAccessKeysInput{UserName: aws.String(p.bktUserName)})
+		if err != nil {
+			return nil, fmt.Errorf("error listing access keys of user %q: %v", p.bktUserName, err)
+		}
+		active := map[string]bool{}
+		for _, k := range keys.AccessKeyMetadata {
+			active[aws.StringValue(k.AccessKeyId)] = aws.StringValue(k.Status) == awsuser.StatusTypeActive
+		}
+		for _, id := range strings.Split(p.bktUserAccessId, ",") {
+			if id != "" && !active[id] {
+				d.keysInvalid = true
+			}
+		}
+	}
+	return d, nil
+}
+
+// repairDrift recreates the claim's missing user, policy and access key and
+// reattaches its policy. New access keys are written to the claim's Secret
+// and recorded in the OB. A missing bucket is not recreated, as its data is
+// lost, nor are missing bucket policy statements, as the principal they
+// granted access to isn't recorded.
+func (r *bucketReconciler) repairDrift(p *awsS3Provisioner, d *driftReport, ob *v1alpha1.ObjectBucket, options *apibkt.BucketOptions) error {
+
+	if p.policyMode() != policyModeManaged || d.bucketMissing {
+		return nil
+	}
+	uname := p.bktUserName
+	tags := p.ownerTags(options)
+
+	if d.userMissing {
+		glog.Infof("reconciler: recreating IAM user %q for OB %q", uname, ob.Name)
+		_, err := p.iamsvc.CreateUser(&awsuser.CreateUserInput{
+			UserName: aws.String(uname),
+			Path:     aws.String(p.iamPath()),
+			Tags:     iamTags(tags),
+		})
+		if err != nil {
+			return fmt.Errorf("error recreating IAM user %q: %v", uname, err)
+		}
+		d.userMissing = false
+	}
+
+	if d.policyMissing {
+		glog.Infof("reconciler: recreating IAM policy %q for OB %q", p.bktUserPolicyArn, ob.Name)
+		arn := p.bktUserPolicyArn
+		doc, err := p.createBucketPolicyDocument(p.bucketName, options)
+		if err != nil {
+			return err
+		}
+		out, err := p.createUserPolicy(p.iamsvc, uname, doc, tags)
+		if err != nil {
+			return fmt.Errorf("error recreating IAM policy %q: %v", arn, err)
+		}
+		p.bktUserPolicyArn = aws.StringValue(out.Policy.Arn)
+		d.policyMissing = false
+	}
+
+	if d.policyDetached {
+		glog.Infof("reconciler: attaching IAM policy %q to user %q", p.bktUserPolicyArn, uname)
+		_, err := p.iamsvc.AttachUserPolicy(&awsuser.AttachUserPolicyInput{
+			PolicyArn: aws.String(p.bktUserPolicyArn),
+			UserName:  aws.String(uname),
+		})
+		if err != nil {
+			return fmt.Errorf("error attaching IAM policy %q to user %q: %v", p.bktUserPolicyArn, uname, err)
+		}
+		d.policyDetached = false
+	}
+
+	if d.keysInvalid {
+		// IAM users have at most two keys, make room for the new one
+		for _, id := range strings.Split(p.bktUserAccessId, ",") {
+			if id == "" {
+				continue
+			}
+			_, err := p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{AccessKeyId: aws.String(id), UserName: aws.String(uname)})
+			if err != nil && !isNoSuchEntityError(err) {
+				return fmt.Errorf("error deleting access key %q of user %q: %v", id, uname, err)
+			}
+		}
+		accessKeyId, secretKey, err := p.createAccessKey(uname)
+		if err != nil {
+			return fmt.Errorf("error creating access key for user %q: %v", uname, err)
+		}
+		glog.Infof("reconciler: replaced access key of user %q for OB %q with %q", uname, ob.Name, accessKeyId)
+		p.bktUserAccessId = accessKeyId
+		err = r.refreshCredentials(options.ObjectBucketClaim, accessKeyId, secretKey)
+		if err != nil {
+			return err
+		}
+		d.keysInvalid = false
+	}
+
+	return r.recordRepairedState(ob.Name, p)
+}
+
+// refreshCredentials writes the access key to the claim's Secret.
+func (r *bucketReconciler) refreshCredentials(obc *v1alpha1.ObjectBucketClaim, accessKeyId, secretKey string) error {
+
+	// the Secret is named after the claim
+	secrets := r.prov.clientset.CoreV1().Secrets(obc.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(obc.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error getting Secret of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+		}
+		secret.StringData = map[string]string{
+			v1alpha1.AwsKeyField:    accessKeyId,
+			v1alpha1.AwsSecretField: secretKey,
+		}
+		_, err = secrets.Update(secret)
+		return err
+	})
+}
+
+// recordRepairedState records the policy and access key of a repaired
+// claim in the OB's AdditionalState.
+func (r *bucketReconciler) recordRepairedState(obName string, p *awsS3Provisioner) error {
+
+	obs := r.libClientset.ObjectbucketV1alpha1().ObjectBuckets()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ob, err := obs.Get(obName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		state := ob.Spec.AdditionalState
+		if state[obStateARN] == p.bktUserPolicyArn && state[obStateAccessKeys] == p.bktUserAccessId {
+			return nil
+		}
+		if state == nil {
+			state = map[string]string{}
+			ob.Spec.AdditionalState = state
+		}
+		state[obStateARN] = p.bktUserPolicyArn
+		state[obStateAccessKeys] = p.bktUserAccessId
+		_, err = obs.Update(ob)
+		return err
+	})
+}
+
+// recordDrift reports drift found on the backend, or its resolution, with
+// an event and the OB's phase, which is Failed while the claim's bucket or
+// credentials are broken. The findings are kept in an OB annotation so each
+// change is only reported once.
+func (r *bucketReconciler) recordDrift(p *awsS3Provisioner, ob *v1alpha1.ObjectBucket, findings []string) error {
+
+	msg := strings.Join(findings, "; ")
+	if ob.Annotations[annotationDrift] == msg {
+		return nil
+	}
+
+	if msg == "" {
+		glog.Infof("reconciler: drift of OB %q resolved", ob.Name)
+		p.eventf(ob, corev1.EventTypeNormal, "DriftResolved", "bucket %q and its credentials match the recorded state", p.bucketName)
+		if ob.Status.Phase == v1alpha1.ObjectBucketStatusPhaseFailed {
+			err := p.setOBPhase(ob.Name, v1alpha1.ObjectBucketStatusPhaseBound)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		glog.Errorf("reconciler: drift of OB %q: %s", ob.Name, msg)
+		p.eventf(ob, corev1.EventTypeWarning, "DriftDetected", msg)
+		err := p.setOBPhase(ob.Name, v1alpha1.ObjectBucketStatusPhaseFailed)
+		if err != nil {
+			return err
+		}
+	}
+	return setOBAnnotations(r.libClientset, ob.Name, map[string]string{annotationDrift: msg})
+}
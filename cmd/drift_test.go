@@ -0,0 +1,253 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	libfake "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned/fake"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDriftRepair(t *testing.T) {
+
+	const uname = "ns-claim-abcde"
+	arn := fmt.Sprintf(policyArn, fakeAccountID, "/obc/cluster-a/", uname)
+
+	tests := []struct {
+		name string
+		s3   *fakeS3
+		// drift from what was provisioned
+		setup  func(f *fakeIAM)
+		repair bool
+		// substrings of the findings once done, none if in sync
+		wantFindings []string
+		// access key in the Secret and the OB once done
+		wantKey   string
+		wantCalls []string
+		notCalled []string
+	}{
+		{
+			name:      "in sync",
+			repair:    true,
+			wantKey:   "AKID-old",
+			notCalled: []string{"CreateUser", "CreatePolicy", "AttachUserPolicy", "CreateAccessKey"},
+		},
+		{
+			name:      "access key deleted",
+			setup:     func(f *fakeIAM) { delete(f.keys, uname) },
+			repair:    true,
+			wantKey:   "AKID1",
+			wantCalls: []string{"DeleteAccessKey AKID-old", "CreateAccessKey " + uname},
+			notCalled: []string{"CreateUser", "CreatePolicy", "AttachUserPolicy"},
+		},
+		{
+			name:      "access key inactive",
+			setup:     func(f *fakeIAM) { f.inactive["AKID-old"] = true },
+			repair:    true,
+			wantKey:   "AKID1",
+			wantCalls: []string{"DeleteAccessKey AKID-old", "CreateAccessKey " + uname},
+		},
+		{
+			name:         "access key deleted without repair",
+			setup:        func(f *fakeIAM) { delete(f.keys, uname) },
+			wantFindings: []string{`access key "AKID-old"`},
+			wantKey:      "AKID-old",
+			notCalled:    []string{"DeleteAccessKey", "CreateAccessKey"},
+		},
+		{
+			name: "user deleted",
+			setup: func(f *fakeIAM) {
+				delete(f.users, uname)
+				delete(f.keys, uname)
+				delete(f.attached, arn)
+			},
+			repair:    true,
+			wantKey:   "AKID1",
+			wantCalls: []string{"CreateUser " + uname, "AttachUserPolicy " + arn, "CreateAccessKey " + uname},
+			notCalled: []string{"CreatePolicy"},
+		},
+		{
+			name: "policy deleted",
+			setup: func(f *fakeIAM) {
+				delete(f.policies, arn)
+				delete(f.attached, arn)
+			},
+			repair:    true,
+			wantKey:   "AKID-old",
+			wantCalls: []string{"CreatePolicy " + uname, "AttachUserPolicy " + arn},
+			notCalled: []string{"CreateUser", "CreateAccessKey"},
+		},
+		{
+			name:      "policy detached",
+			setup:     func(f *fakeIAM) { delete(f.attached, arn) },
+			repair:    true,
+			wantKey:   "AKID-old",
+			wantCalls: []string{"AttachUserPolicy " + arn},
+			notCalled: []string{"CreatePolicy", "CreateAccessKey"},
+		},
+		{
+			name: "bucket deleted",
+			s3:   &fakeS3{noBucket: true},
+			setup: func(f *fakeIAM) {
+				delete(f.keys, uname)
+			},
+			repair:       true,
+			wantFindings: []string{`bucket "bkt" no longer exists`, `access key "AKID-old"`},
+			wantKey:      "AKID-old",
+			notCalled:    []string{"CreateAccessKey"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obc := &v1alpha1.ObjectBucketClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "claim", UID: "uid-1"},
+				Spec:       v1alpha1.ObjectBucketClaimSpec{StorageClassName: "s3"},
+			}
+			ob := &v1alpha1.ObjectBucket{
+				ObjectMeta: metav1.ObjectMeta{Name: "obc-ns-claim"},
+				Spec: v1alpha1.ObjectBucketSpec{Connection: &v1alpha1.Connection{AdditionalState: map[string]string{
+					obStateARN:        arn,
+					obStateAccessKeys: "AKID-old",
+				}}},
+				Status: v1alpha1.ObjectBucketStatus{Phase: v1alpha1.ObjectBucketStatusPhaseBound},
+			}
+			kube := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "claim"},
+				Data:       map[string][]byte{v1alpha1.AwsKeyField: []byte("AKID-old"), v1alpha1.AwsSecretField: []byte("secret-old")},
+			})
+			lib := libfake.NewSimpleClientset(ob)
+
+			f := newFakeIAM()
+			f.users[uname] = map[string]string{tagClusterID: "cluster-a", tagProvisioner: provisionerName, tagOBCUID: "uid-1"}
+			f.keys[uname] = []string{"AKID-old"}
+			f.policies[arn] = true
+			f.attached[arn] = uname
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			s3 := tt.s3
+			if s3 == nil {
+				s3 = &fakeS3{}
+			}
+			p := &awsS3Provisioner{
+				bucketName:       "bkt",
+				bktCreateUser:    "yes",
+				bktUserName:      uname,
+				bktUserPolicyArn: arn,
+				bktUserAccessId:  "AKID-old",
+				clusterID:        "cluster-a",
+				iamPathPrefix:    "/obc/",
+				s3svc:            s3,
+				iamsvc:           f,
+				clientset:        kube,
+				libClientset:     lib,
+			}
+			r := &bucketReconciler{prov: *p, libClientset: lib}
+			options := &apibkt.BucketOptions{BucketName: "bkt", ObjectBucketClaim: obc, Parameters: map[string]string{}}
+
+			// as the reconciler does
+			drift, err := p.detectDrift()
+			if err != nil {
+				t.Fatalf("detectDrift() error = %v", err)
+			}
+			if tt.repair {
+				err = r.repairDrift(p, drift, ob, options)
+				if err != nil {
+					t.Fatalf("repairDrift() error = %v", err)
+				}
+			}
+			findings := drift.findings(p)
+			err = r.recordDrift(p, ob, findings)
+			if err != nil {
+				t.Fatalf("recordDrift() error = %v", err)
+			}
+
+			if len(findings) != len(tt.wantFindings) {
+				t.Errorf("findings %q, want %q", findings, tt.wantFindings)
+			}
+			msg := strings.Join(findings, "; ")
+			for _, want := range tt.wantFindings {
+				if !strings.Contains(msg, want) {
+					t.Errorf("findings %q, want them to contain %q", findings, want)
+				}
+			}
+
+			// the repair holds, and the claim's credentials are recorded
+			if tt.repair && !drift.bucketMissing {
+				again, err := p.detectDrift()
+				if err != nil {
+					t.Fatalf("detectDrift() error = %v", err)
+				}
+				if left := again.findings(p); len(left) > 0 {
+					t.Errorf("drift left after repair %q", left)
+				}
+			}
+			secret, err := kube.CoreV1().Secrets("ns").Get("claim", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("getting Secret: %v", err)
+			}
+			key, secretKey := secret.StringData[v1alpha1.AwsKeyField], secret.StringData[v1alpha1.AwsSecretField]
+			if key == "" {
+				key, secretKey = string(secret.Data[v1alpha1.AwsKeyField]), string(secret.Data[v1alpha1.AwsSecretField])
+			}
+			wantSecret := "secret-" + tt.wantKey
+			if tt.wantKey == "AKID-old" {
+				wantSecret = "secret-old"
+			}
+			if key != tt.wantKey || secretKey != wantSecret {
+				t.Errorf("Secret holds %q/%q, want %q/%q", key, secretKey, tt.wantKey, wantSecret)
+			}
+			saved, err := lib.ObjectbucketV1alpha1().ObjectBuckets().Get(ob.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("getting OB: %v", err)
+			}
+			state := saved.Spec.AdditionalState
+			if state[obStateAccessKeys] != tt.wantKey || state[obStateARN] != arn {
+				t.Errorf("OB state %v, want access key %q and policy %q", state, tt.wantKey, arn)
+			}
+			wantPhase := v1alpha1.ObjectBucketStatusPhaseBound
+			if len(tt.wantFindings) > 0 {
+				wantPhase = v1alpha1.ObjectBucketStatusPhaseFailed
+			}
+			if saved.Status.Phase != wantPhase || saved.Annotations[annotationDrift] != msg {
+				t.Errorf("OB phase %q and drift %q, want %q and %q", saved.Status.Phase, saved.Annotations[annotationDrift], wantPhase, msg)
+			}
+
+			next := 0
+			for _, call := range f.calls {
+				if next < len(tt.wantCalls) && call == tt.wantCalls[next] {
+					next++
+				}
+				for _, not := range tt.notCalled {
+					if strings.HasPrefix(call, not+" ") {
+						t.Errorf("unexpected call %q", call)
+					}
+				}
+			}
+			if next < len(tt.wantCalls) {
+				t.Errorf("calls %q, want in order %q", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+)
+
+const (
+	// bucket configuration keys
+	cfgEncryption      = "encryption"
+	cfgKMSKeyID        = "kmsKeyId"
+	cfgDenyUnencrypted = "denyUnencryptedUploads"
+	// encryption values
+	encryptionSSES3  = "SSE-S3"
+	encryptionSSEKMS = "SSE-KMS"
+	// internal value removing the default encryption, never configured
+	encryptionNone = "none"
+	// keys added to the OBC's ConfigMap
+	configMapEncryption = "BUCKET_ENCRYPTION"
+	configMapKMSKeyID   = "BUCKET_KMS_KEY_ID"
+	// Sid of the bucket policy statement denying unencrypted uploads
+	denyUnencryptedSid = bucketPolicySidPrefix + "DenyUnencryptedUploads"
+)
+
+// getEncryptionConfig validates and sets the encryption settings of cfg.
+func getEncryptionConfig(cfg *bucketConfig, params map[string]string, obc *v1alpha1.ObjectBucketClaim) error {
+
+	cfg.encryption = configValue(params, obc, cfgEncryption)
+	cfg.kmsKeyID = configValue(params, obc, cfgKMSKeyID)
+	switch cfg.encryption {
+	case "", encryptionSSES3:
+		if cfg.kmsKeyID != "" {
+			return fmt.Errorf("%s requires %s %q", cfgKMSKeyID, cfgEncryption, encryptionSSEKMS)
+		}
+	case encryptionSSEKMS:
+	default:
+		return fmt.Errorf("invalid %s %q, must be %q or %q", cfgEncryption, cfg.encryption, encryptionSSES3, encryptionSSEKMS)
+	}
+
+	cfg.denyUnencrypted = configValue(params, obc, cfgDenyUnencrypted)
+	switch cfg.denyUnencrypted {
+	case "", "yes", "no":
+	default:
+		return fmt.Errorf("invalid %s %q, must be \"yes\" or \"no\"", cfgDenyUnencrypted, cfg.denyUnencrypted)
+	}
+	return nil
+}
+
+// applyEncryption sets the bucket's default server side encryption, or
+// removes it for encryptionNone.
+func (p *awsS3Provisioner) applyEncryption(bktName string, cfg *bucketConfig) error {
+
+	if cfg.encryption == encryptionNone {
+		glog.V(2).Infof("removing default encryption of bucket %q", bktName)
+		_, err := p.s3svc.DeleteBucketEncryption(&s3.DeleteBucketEncryptionInput{Bucket: aws.String(bktName)})
+		if err != nil {
+			return fmt.Errorf("error removing default encryption of bucket %q: %v", bktName, err)
+		}
+		return nil
+	}
+
+	rule := &s3.ServerSideEncryptionByDefault{
+		SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+	}
+	if cfg.encryption == encryptionSSEKMS {
+		rule.SSEAlgorithm = aws.String(s3.ServerSideEncryptionAwsKms)
+		if cfg.kmsKeyID != "" {
+			rule.KMSMasterKeyID = aws.String(cfg.kmsKeyID)
+		}
+	}
+
+	glog.V(2).Infof("setting default encryption of bucket %q to %s", bktName, cfg.encryption)
+	_, err := p.s3svc.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bktName),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: rule}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting default encryption of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
+
+// applyDenyUnencrypted adds or removes the bucket policy statement denying
+// uploads without a server side encryption header.
+func (p *awsS3Provisioner) applyDenyUnencrypted(bktName string, deny bool) error {
+
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		return err
+	}
+	removed := policy.removeStatements(denyUnencryptedSid)
+	if !deny && removed == 0 {
+		return nil
+	}
+
+	if deny {
+		glog.V(2).Infof("denying unencrypted uploads to bucket %q", bktName)
+		raw, err := json.Marshal(&bucketPolicyStatement{
+			Sid:       denyUnencryptedSid,
+			Effect:    "Deny",
+			Principal: "*",
+			Action:    []string{"s3:PutObject"},
+			Resource:  []string{fmt.Sprintf(s3BucketArn, bktName) + "/*"},
+			Condition: map[string]map[string]string{
+				"Null": {"s3:x-amz-server-side-encryption": "true"},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling bucket policy statement, %s", err.Error())
+		}
+		if policy.Version == "" {
+			policy.Version = "2012-10-17"
+		}
+		policy.Statement = append(policy.Statement, raw)
+	}
+
+	err = p.putBucketPolicy(bktName, policy)
+	if err != nil {
+		return fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
+
+// encryptionConfigData adds the encryption settings reported in the OBC's
+// ConfigMap, so clients know whether to send encryption headers.
+func (cfg *bucketConfig) encryptionConfigData(data map[string]string) {
+	if cfg.encryption != "" {
+		data[configMapEncryption] = cfg.encryption
+	}
+	if cfg.kmsKeyID != "" {
+		data[configMapKMSKeyID] = cfg.kmsKeyID
+	}
+}
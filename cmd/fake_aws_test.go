@@ -0,0 +1,520 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const fakeAccountID = "123456789012"
+
+// fakeS3 is a single bucket backend. Calls not implemented panic through
+// the nil embedded interface.
+type fakeS3 struct {
+	s3iface.S3API
+	// the bucket doesn't exist
+	noBucket bool
+	// tags of the bucket, nil if it has none
+	tags       map[string]string
+	versioning *string
+	lifecycle  []*s3.LifecycleRule
+	encryption *s3.ServerSideEncryptionConfiguration
+	cors       []*s3.CORSRule
+	policy     *string
+	// object versions and delete markers, sorted by key and version
+	objects []fakeObject
+	// keys of the multipart uploads in progress
+	uploads    []string
+	objectLock bool
+	// most versions listed per page, MaxKeys if 0
+	pageSize int
+	// keys whose deletion fails
+	failKeys map[string]bool
+	// calls to the object and upload methods, and the error each fails with
+	mu    sync.Mutex
+	calls []string
+	fail  map[string]error
+}
+
+// fakeObject is a version, or delete marker, of an object.
+type fakeObject struct {
+	key, version string
+	marker       bool
+}
+
+// fakeObjects returns a version of each key.
+func fakeObjects(keys ...string) []fakeObject {
+	objects := []fakeObject{}
+	for _, k := range keys {
+		objects = append(objects, fakeObject{key: k, version: "v1"})
+	}
+	return objects
+}
+
+func (f *fakeS3) call(name, arg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name+" "+arg)
+	return f.fail[name]
+}
+
+func (f *fakeS3) bucketErr() error {
+	if f.noBucket {
+		return awserr.New(s3.ErrCodeNoSuchBucket, "no such bucket", nil)
+	}
+	return nil
+}
+
+func (f *fakeS3) GetBucketTagging(in *s3.GetBucketTaggingInput) (*s3.GetBucketTaggingOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if f.tags == nil {
+		return nil, awserr.New(errNoSuchTagSet, "no tags", nil)
+	}
+	out := &s3.GetBucketTaggingOutput{}
+	for k, v := range f.tags {
+		out.TagSet = append(out.TagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) PutBucketTagging(in *s3.PutBucketTaggingInput) (*s3.PutBucketTaggingOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	f.tags = map[string]string{}
+	for _, t := range in.Tagging.TagSet {
+		f.tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return &s3.PutBucketTaggingOutput{}, nil
+}
+
+func (f *fakeS3) GetBucketVersioning(in *s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	return &s3.GetBucketVersioningOutput{Status: f.versioning}, nil
+}
+
+func (f *fakeS3) GetBucketLifecycleConfiguration(in *s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if f.lifecycle == nil {
+		return nil, awserr.New(errNoSuchLifecycleConfig, "no lifecycle", nil)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: f.lifecycle}, nil
+}
+
+func (f *fakeS3) GetBucketEncryption(in *s3.GetBucketEncryptionInput) (*s3.GetBucketEncryptionOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if f.encryption == nil {
+		return nil, awserr.New(errNoEncryptionConfig, "no encryption", nil)
+	}
+	return &s3.GetBucketEncryptionOutput{ServerSideEncryptionConfiguration: f.encryption}, nil
+}
+
+func (f *fakeS3) GetBucketCors(in *s3.GetBucketCorsInput) (*s3.GetBucketCorsOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if f.cors == nil {
+		return nil, awserr.New(errNoSuchCORSConfig, "no CORS", nil)
+	}
+	return &s3.GetBucketCorsOutput{CORSRules: f.cors}, nil
+}
+
+func (f *fakeS3) GetBucketPolicy(in *s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if f.policy == nil {
+		return nil, awserr.New(errNoSuchBucketPolicy, "no policy", nil)
+	}
+	return &s3.GetBucketPolicyOutput{Policy: f.policy}, nil
+}
+
+func (f *fakeS3) PutBucketPolicy(in *s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	f.policy = aws.String(aws.StringValue(in.Policy))
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+func (f *fakeS3) DeleteBucketPolicy(in *s3.DeleteBucketPolicyInput) (*s3.DeleteBucketPolicyOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	f.policy = nil
+	return &s3.DeleteBucketPolicyOutput{}, nil
+}
+
+func (f *fakeS3) HeadBucket(in *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	if f.noBucket {
+		return nil, awserr.New(errCodeNotFound, "not found", nil)
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectLockConfiguration(in *s3.GetObjectLockConfigurationInput) (*s3.GetObjectLockConfigurationOutput, error) {
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if !f.objectLock {
+		return nil, awserr.New(errNoObjectLockConfig, "no object lock", nil)
+	}
+	return &s3.GetObjectLockConfigurationOutput{ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+		ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+	}}, nil
+}
+
+func (f *fakeS3) ListObjectVersions(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	if err := f.call("ListObjectVersions", aws.StringValue(in.KeyMarker)); err != nil {
+		return nil, err
+	}
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := int(aws.Int64Value(in.MaxKeys))
+	if f.pageSize > 0 && f.pageSize < n {
+		n = f.pageSize
+	}
+	key, version := aws.StringValue(in.KeyMarker), aws.StringValue(in.VersionIdMarker)
+	out := &s3.ListObjectVersionsOutput{IsTruncated: aws.Bool(false)}
+	listed := 0
+	for _, o := range f.objects {
+		if in.KeyMarker != nil && (o.key < key || o.key == key && o.version <= version) {
+			continue
+		}
+		if listed == n {
+			out.IsTruncated = aws.Bool(true)
+			break
+		}
+		if o.marker {
+			out.DeleteMarkers = append(out.DeleteMarkers, &s3.DeleteMarkerEntry{Key: aws.String(o.key), VersionId: aws.String(o.version)})
+		} else {
+			out.Versions = append(out.Versions, &s3.ObjectVersion{Key: aws.String(o.key), VersionId: aws.String(o.version)})
+		}
+		out.NextKeyMarker, out.NextVersionIdMarker = aws.String(o.key), aws.String(o.version)
+		listed++
+	}
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	if err := f.call("DeleteObjects", fmt.Sprint(len(in.Delete.Objects))); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.DeleteObjectsOutput{}
+	for _, id := range in.Delete.Objects {
+		key, version := aws.StringValue(id.Key), aws.StringValue(id.VersionId)
+		if f.failKeys[key] {
+			out.Errors = append(out.Errors, &s3.Error{Key: id.Key, VersionId: id.VersionId, Code: aws.String("AccessDenied"), Message: aws.String("denied")})
+			continue
+		}
+		for i, o := range f.objects {
+			if o.key == key && o.version == version {
+				f.objects = append(f.objects[:i], f.objects[i+1:]...)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListMultipartUploadsPages(in *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	if err := f.call("ListMultipartUploads", ""); err != nil {
+		return err
+	}
+	if err := f.bucketErr(); err != nil {
+		return err
+	}
+	page := &s3.ListMultipartUploadsOutput{}
+	for _, k := range f.uploads {
+		page.Uploads = append(page.Uploads, &s3.MultipartUpload{Key: aws.String(k), UploadId: aws.String("upload-" + k)})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	key := aws.StringValue(in.Key)
+	if err := f.call("AbortMultipartUpload", key); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, k := range f.uploads {
+		if k == key {
+			f.uploads = append(f.uploads[:i], f.uploads[i+1:]...)
+			break
+		}
+	}
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) DeleteBucket(in *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
+	if err := f.call("DeleteBucket", aws.StringValue(in.Bucket)); err != nil {
+		return nil, err
+	}
+	if err := f.bucketErr(); err != nil {
+		return nil, err
+	}
+	if len(f.objects) > 0 || len(f.uploads) > 0 {
+		return nil, awserr.New("BucketNotEmpty", "bucket not empty", nil)
+	}
+	f.noBucket = true
+	return &s3.DeleteBucketOutput{}, nil
+}
+
+// fakeIAM is an IAM backend holding users, their access keys and managed
+// policies. Each call is logged, and fails with the error in fail if any.
+type fakeIAM struct {
+	iamiface.IAMAPI
+	// tags of each user
+	users map[string]map[string]string
+	// access key ids of each user, and those deactivated
+	keys     map[string][]string
+	inactive map[string]bool
+	// existing policies, and the user each is attached to
+	policies map[string]bool
+	attached map[string]string
+	fail     map[string]error
+	calls    []string
+	nextKey  int
+}
+
+func newFakeIAM() *fakeIAM {
+	return &fakeIAM{
+		users:    map[string]map[string]string{},
+		keys:     map[string][]string{},
+		inactive: map[string]bool{},
+		policies: map[string]bool{},
+		attached: map[string]string{},
+		fail:     map[string]error{},
+	}
+}
+
+func noSuchEntity(what string) error {
+	return awserr.New(awsuser.ErrCodeNoSuchEntityException, what+" not found", nil)
+}
+
+func (f *fakeIAM) call(name, arg string) error {
+	f.calls = append(f.calls, name+" "+arg)
+	return f.fail[name]
+}
+
+func (f *fakeIAM) GetUser(in *awsuser.GetUserInput) (*awsuser.GetUserOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("GetUser", name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.users[name]; !ok {
+		return nil, noSuchEntity("user")
+	}
+	return &awsuser.GetUserOutput{User: &awsuser.User{
+		UserName: in.UserName,
+		Arn:      aws.String(fmt.Sprintf("arn:aws:iam::%s:user/%s", fakeAccountID, name)),
+	}}, nil
+}
+
+func (f *fakeIAM) CreateUser(in *awsuser.CreateUserInput) (*awsuser.CreateUserOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("CreateUser", name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.users[name]; ok {
+		return nil, awserr.New(awsuser.ErrCodeEntityAlreadyExistsException, "user exists", nil)
+	}
+	tags := map[string]string{}
+	for _, t := range in.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	f.users[name] = tags
+	return &awsuser.CreateUserOutput{}, nil
+}
+
+func (f *fakeIAM) DeleteUser(in *awsuser.DeleteUserInput) (*awsuser.DeleteUserOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("DeleteUser", name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.users[name]; !ok {
+		return nil, noSuchEntity("user")
+	}
+	delete(f.users, name)
+	return &awsuser.DeleteUserOutput{}, nil
+}
+
+func (f *fakeIAM) ListUserTags(in *awsuser.ListUserTagsInput) (*awsuser.ListUserTagsOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("ListUserTags", name); err != nil {
+		return nil, err
+	}
+	tags, ok := f.users[name]
+	if !ok {
+		return nil, noSuchEntity("user")
+	}
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := &awsuser.ListUserTagsOutput{}
+	for _, k := range keys {
+		out.Tags = append(out.Tags, &awsuser.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) CreateAccessKey(in *awsuser.CreateAccessKeyInput) (*awsuser.CreateAccessKeyOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("CreateAccessKey", name); err != nil {
+		return nil, err
+	}
+	f.nextKey++
+	id := fmt.Sprintf("AKID%d", f.nextKey)
+	f.keys[name] = append(f.keys[name], id)
+	return &awsuser.CreateAccessKeyOutput{AccessKey: &awsuser.AccessKey{
+		AccessKeyId:     aws.String(id),
+		SecretAccessKey: aws.String("secret-" + id),
+	}}, nil
+}
+
+func (f *fakeIAM) ListAccessKeys(in *awsuser.ListAccessKeysInput) (*awsuser.ListAccessKeysOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("ListAccessKeys", name); err != nil {
+		return nil, err
+	}
+	out := &awsuser.ListAccessKeysOutput{}
+	for _, id := range f.keys[name] {
+		status := awsuser.StatusTypeActive
+		if f.inactive[id] {
+			status = awsuser.StatusTypeInactive
+		}
+		out.AccessKeyMetadata = append(out.AccessKeyMetadata, &awsuser.AccessKeyMetadata{AccessKeyId: aws.String(id), Status: aws.String(status)})
+	}
+	return out, nil
+}
+
+func (f *fakeIAM) DeleteAccessKey(in *awsuser.DeleteAccessKeyInput) (*awsuser.DeleteAccessKeyOutput, error) {
+	name, id := aws.StringValue(in.UserName), aws.StringValue(in.AccessKeyId)
+	if err := f.call("DeleteAccessKey", id); err != nil {
+		return nil, err
+	}
+	for i, k := range f.keys[name] {
+		if k == id {
+			f.keys[name] = append(f.keys[name][:i], f.keys[name][i+1:]...)
+			return &awsuser.DeleteAccessKeyOutput{}, nil
+		}
+	}
+	return nil, noSuchEntity("access key")
+}
+
+func (f *fakeIAM) CreatePolicy(in *awsuser.CreatePolicyInput) (*awsuser.CreatePolicyOutput, error) {
+	name := aws.StringValue(in.PolicyName)
+	if err := f.call("CreatePolicy", name); err != nil {
+		return nil, err
+	}
+	arn := fmt.Sprintf(policyArn, fakeAccountID, aws.StringValue(in.Path), name)
+	f.policies[arn] = true
+	return &awsuser.CreatePolicyOutput{Policy: &awsuser.Policy{Arn: aws.String(arn)}}, nil
+}
+
+func (f *fakeIAM) GetPolicy(in *awsuser.GetPolicyInput) (*awsuser.GetPolicyOutput, error) {
+	arn := aws.StringValue(in.PolicyArn)
+	if err := f.call("GetPolicy", arn); err != nil {
+		return nil, err
+	}
+	if !f.policies[arn] {
+		return nil, noSuchEntity("policy")
+	}
+	return &awsuser.GetPolicyOutput{Policy: &awsuser.Policy{Arn: in.PolicyArn}}, nil
+}
+
+func (f *fakeIAM) DeletePolicy(in *awsuser.DeletePolicyInput) (*awsuser.DeletePolicyOutput, error) {
+	arn := aws.StringValue(in.PolicyArn)
+	if err := f.call("DeletePolicy", arn); err != nil {
+		return nil, err
+	}
+	if !f.policies[arn] {
+		return nil, noSuchEntity("policy")
+	}
+	if _, ok := f.attached[arn]; ok {
+		return nil, awserr.New(awsuser.ErrCodeDeleteConflictException, "policy is attached", nil)
+	}
+	delete(f.policies, arn)
+	return &awsuser.DeletePolicyOutput{}, nil
+}
+
+func (f *fakeIAM) AttachUserPolicy(in *awsuser.AttachUserPolicyInput) (*awsuser.AttachUserPolicyOutput, error) {
+	arn := aws.StringValue(in.PolicyArn)
+	if err := f.call("AttachUserPolicy", arn); err != nil {
+		return nil, err
+	}
+	if !f.policies[arn] {
+		return nil, noSuchEntity("policy")
+	}
+	f.attached[arn] = aws.StringValue(in.UserName)
+	return &awsuser.AttachUserPolicyOutput{}, nil
+}
+
+func (f *fakeIAM) DetachUserPolicy(in *awsuser.DetachUserPolicyInput) (*awsuser.DetachUserPolicyOutput, error) {
+	arn := aws.StringValue(in.PolicyArn)
+	if err := f.call("DetachUserPolicy", arn); err != nil {
+		return nil, err
+	}
+	if f.attached[arn] != aws.StringValue(in.UserName) {
+		return nil, noSuchEntity("attachment")
+	}
+	delete(f.attached, arn)
+	return &awsuser.DetachUserPolicyOutput{}, nil
+}
+
+func (f *fakeIAM) ListAttachedUserPolicies(in *awsuser.ListAttachedUserPoliciesInput) (*awsuser.ListAttachedUserPoliciesOutput, error) {
+	name := aws.StringValue(in.UserName)
+	if err := f.call("ListAttachedUserPolicies", name); err != nil {
+		return nil, err
+	}
+	if _, ok := f.users[name]; !ok {
+		return nil, noSuchEntity("user")
+	}
+	out := &awsuser.ListAttachedUserPoliciesOutput{}
+	for arn, user := range f.attached {
+		if user == name {
+			out.AttachedPolicies = append(out.AttachedPolicies, &awsuser.AttachedPolicy{PolicyArn: aws.String(arn)})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	storageV1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// entities younger than this may still be being provisioned, so are
+	// never reported as orphans
+	gcGracePeriod = 10 * time.Minute
+)
+
+// gcMetrics are published on the metrics endpoint under "gc".
+var gcMetrics = expvar.NewMap("gc")
+
+// garbageCollector periodically looks for IAM users, policies and buckets
+// created by the operator for this cluster which no longer belong to an
+// ObjectBucket. These are left behind by failed rollbacks, crashes and
+// manual deletion of OBs. Orphans are reported as metrics and as events on
+// the storage class whose credentials found them, and optionally deleted.
+type garbageCollector struct {
+	// prov is copied for each storage class to create its sessions
+	prov         awsS3Provisioner
+	libClientset versioned.Interface
+	recorder     record.EventRecorder
+	// delete orphans older than minAge
+	deleteOrphans bool
+	minAge        time.Duration
+}
+
+// ownedEntities are the entities recorded in the cluster's ObjectBuckets.
+type ownedEntities struct {
+	users    map[string]bool
+	policies map[string]bool
+	buckets  map[string]bool
+}
+
+// gcCounts are the orphans found and deleted in one run.
+type gcCounts struct {
+	users, policies, buckets int
+	deleted                  int
+	errors                   int
+}
+
+func newGarbageCollector(prov awsS3Provisioner, libClientset versioned.Interface, recorder record.EventRecorder, deleteOrphans bool, minAge time.Duration) *garbageCollector {
+	return &garbageCollector{
+		prov:          prov,
+		libClientset:  libClientset,
+		recorder:      recorder,
+		deleteOrphans: deleteOrphans,
+		minAge:        minAge,
+	}
+}
+
+// run checks the entities found with the credentials of each of our
+// storage classes against the existing ObjectBuckets.
+func (gc *garbageCollector) run() {
+
+	glog.V(2).Infof("gc: looking for orphaned users, policies and buckets")
+	counts := &gcCounts{}
+	defer gc.publish(counts)
+
+	owned, err := gc.ownedEntities()
+	if err != nil {
+		glog.Errorf("gc: error listing ObjectBuckets: %v", err)
+		counts.errors++
+		return
+	}
+
+	classes, err := gc.prov.clientset.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("gc: error listing storage classes: %v", err)
+		counts.errors++
+		return
+	}
+
+	// storage classes sharing an endpoint and owner only need checking once
+	checked := map[string]bool{}
+	for i := range classes.Items {
+		sc := &classes.Items[i]
+		if sc.Provisioner != provisionerName {
+			continue
+		}
+
+		p := gc.prov
+		err = p.setSessionAndService(sc)
+		if err != nil {
+			glog.Errorf("gc: skipping storage class %q: %v", sc.Name, err)
+			counts.errors++
+			continue
+		}
+		key := p.bktOwnerAccessId + "@" + aws.StringValue(p.s3Session.Config.Endpoint)
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		p.setCreateBucketUserOptions(sc)
+		if p.bktCreateUser == "yes" {
+			gc.collectUsers(&p, sc, owned, counts)
+			gc.collectPolicies(&p, sc, owned, counts)
+		}
+		gc.collectBuckets(&p, sc, owned, counts)
+	}
+	glog.V(2).Infof("gc: found %d orphaned users, %d policies and %d buckets, deleted %d",
+		counts.users, counts.policies, counts.buckets, counts.deleted)
+}
+
+// ownedEntities returns the users, policies and buckets recorded in the
+// cluster's ObjectBuckets.
+func (gc *garbageCollector) ownedEntities() (*ownedEntities, error) {
+
+	obs, err := gc.libClientset.ObjectbucketV1alpha1().ObjectBuckets().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	owned := &ownedEntities{
+		users:    map[string]bool{},
+		policies: map[string]bool{},
+		buckets:  map[string]bool{},
+	}
+	for _, ob := range obs.Items {
+		if ob.Spec.Connection == nil {
+			continue
+		}
+		owned.users[ob.Spec.AdditionalState[obStateUser]] = true
+		owned.policies[ob.Spec.AdditionalState[obStateARN]] = true
+		if ob.Spec.Endpoint != nil {
+			owned.buckets[ob.Spec.Endpoint.BucketName] = true
+		}
+	}
+	return owned, nil
+}
+
+// collectUsers handles the users under the operator's IAM path that are
+// tagged with this cluster's id.
+func (gc *garbageCollector) collectUsers(p *awsS3Provisioner, sc *storageV1.StorageClass, owned *ownedEntities, counts *gcCounts) {
+
+	orphans := map[string]time.Time{}
+	err := p.iamsvc.ListUsersPages(&awsuser.ListUsersInput{PathPrefix: aws.String(p.iamPath())},
+		func(out *awsuser.ListUsersOutput, last bool) bool {
+			for _, u := range out.Users {
+				if !owned.users[aws.StringValue(u.UserName)] {
+					orphans[aws.StringValue(u.UserName)] = aws.TimeValue(u.CreateDate)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		glog.Errorf("gc: error listing users with storage class %q: %v", sc.Name, err)
+		counts.errors++
+		return
+	}
+
+	for uname, created := range orphans {
+		tags, err := p.getUserTags(uname)
+		if err != nil {
+			glog.Errorf("gc: %v", err)
+			counts.errors++
+			continue
+		}
+		if !gc.prov.ownedByCluster(tags) || time.Since(created) < gcGracePeriod {
+			continue
+		}
+
+		counts.users++
+		gc.recorder.Eventf(sc, corev1.EventTypeWarning, "OrphanedUser",
+			"IAM user %q created for claim %s/%s no longer belongs to an ObjectBucket",
+			uname, tags[tagOBCNamespace], tags[tagOBCName])
+		if gc.shouldDelete(created) {
+			gc.deleteOrphan(sc, "user", uname, p.deleteIAMUser, counts)
+		}
+	}
+}
+
+// collectPolicies handles the policies under the operator's IAM path that
+// are described with this cluster's id.
+func (gc *garbageCollector) collectPolicies(p *awsS3Provisioner, sc *storageV1.StorageClass, owned *ownedEntities, counts *gcCounts) {
+
+	orphans := []string{}
+	err := p.iamsvc.ListPoliciesPages(&awsuser.ListPoliciesInput{
+		PathPrefix: aws.String(p.iamPath()),
+		Scope:      aws.String(awsuser.PolicyScopeTypeLocal),
+	}, func(out *awsuser.ListPoliciesOutput, last bool) bool {
+		for _, policy := range out.Policies {
+			if !owned.policies[aws.StringValue(policy.Arn)] {
+				orphans = append(orphans, aws.StringValue(policy.Arn))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		glog.Errorf("gc: error listing policies with storage class %q: %v", sc.Name, err)
+		counts.errors++
+		return
+	}
+
+	for _, arn := range orphans {
+		// the description is only returned by GetPolicy
+		out, err := p.iamsvc.GetPolicy(&awsuser.GetPolicyInput{PolicyArn: aws.String(arn)})
+		if err != nil {
+			glog.Errorf("gc: error getting policy %q: %v", arn, err)
+			counts.errors++
+			continue
+		}
+		tags := parseTagsDescription(aws.StringValue(out.Policy.Description))
+		created := aws.TimeValue(out.Policy.CreateDate)
+		if !gc.prov.ownedByCluster(tags) || time.Since(created) < gcGracePeriod {
+			continue
+		}
+
+		counts.policies++
+		gc.recorder.Eventf(sc, corev1.EventTypeWarning, "OrphanedPolicy",
+			"IAM policy %q created for claim %s/%s no longer belongs to an ObjectBucket",
+			arn, tags[tagOBCNamespace], tags[tagOBCName])
+		if gc.shouldDelete(created) {
+			gc.deleteOrphan(sc, "policy", arn, p.deleteIAMPolicy, counts)
+		}
+	}
+}
+
+// collectBuckets handles the buckets tagged with this cluster's id.
+func (gc *garbageCollector) collectBuckets(p *awsS3Provisioner, sc *storageV1.StorageClass, owned *ownedEntities, counts *gcCounts) {
+
+	out, err := p.s3svc.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		glog.Errorf("gc: error listing buckets with storage class %q: %v", sc.Name, err)
+		counts.errors++
+		return
+	}
+
+	for _, bkt := range out.Buckets {
+		bktName := aws.StringValue(bkt.Name)
+		created := aws.TimeValue(bkt.CreationDate)
+		if owned.buckets[bktName] || time.Since(created) < gcGracePeriod {
+			continue
+		}
+		tags, err := p.getBucketTags(bktName)
+		if err != nil {
+			glog.Errorf("gc: error getting tags of bucket %q: %v", bktName, err)
+			counts.errors++
+			continue
+		}
+		// buckets deliberately kept by their claim aren't orphans
+		if _, ok := tags[tagRetained]; ok || !gc.prov.ownedByCluster(tags) {
+			continue
+		}
+
+		counts.buckets++
+		gc.recorder.Eventf(sc, corev1.EventTypeWarning, "OrphanedBucket",
+			"bucket %q created for claim %s/%s no longer belongs to an ObjectBucket",
+			bktName, tags[tagOBCNamespace], tags[tagOBCName])
+		if gc.shouldDelete(created) {
+			gc.deleteOrphan(sc, "bucket", bktName, p.purgeBucket, counts)
+		}
+	}
+}
+
+// shouldDelete returns true if deletion is enabled and the orphan is older
+// than the minimum age.
+func (gc *garbageCollector) shouldDelete(created time.Time) bool {
+	return gc.deleteOrphans && time.Since(created) >= gc.minAge
+}
+
+func (gc *garbageCollector) deleteOrphan(sc *storageV1.StorageClass, kind, name string, del func(string) error, counts *gcCounts) {
+
+	glog.Infof("gc: deleting orphaned %s %q", kind, name)
+	if err := del(name); err != nil {
+		glog.Errorf("gc: error deleting orphaned %s %q: %v", kind, name, err)
+		gc.recorder.Eventf(sc, corev1.EventTypeWarning, "OrphanDeleteFailed", "error deleting orphaned %s %q: %v", kind, name, err)
+		counts.errors++
+		return
+	}
+	gc.recorder.Eventf(sc, corev1.EventTypeNormal, "OrphanDeleted", "deleted orphaned %s %q", kind, name)
+	counts.deleted++
+}
+
+// publish sets the metrics from the counts of the last run.
+func (gc *garbageCollector) publish(counts *gcCounts) {
+
+	set := func(name string, v int) {
+		i := new(expvar.Int)
+		i.Set(int64(v))
+		gcMetrics.Set(name, i)
+	}
+	set("orphanedUsers", counts.users)
+	set("orphanedPolicies", counts.policies)
+	set("orphanedBuckets", counts.buckets)
+	set("lastRunErrors", counts.errors)
+	gcMetrics.Add("runs", 1)
+	gcMetrics.Add("deleted", int64(counts.deleted))
+	last := new(expvar.String)
+	last.Set(time.Now().UTC().Format(time.RFC3339))
+	gcMetrics.Set("lastRun", last)
+}
@@ -20,10 +20,12 @@ import (
 	"encoding/json"
 	"fmt"
 	_ "net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/golang/glog"
 	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
 	storageV1 "k8s.io/api/storage/v1"
@@ -44,81 +46,158 @@ type StatementEntry struct {
 }
 
 // handleUserAndPolicy takes care of policy and user creation when flag is set.
-func (p *awsS3Provisioner) handleUserAndPolicy(bktName string, options *apibkt.BucketOptions) (userAccessId, userSecretKey string, err error) {
+// Each step is undone by the saga should a later one fail.
+func (p *awsS3Provisioner) handleUserAndPolicy(s *saga, bktName string, options *apibkt.BucketOptions) (userAccessId, userSecretKey string, err error) {
 
 	glog.V(2).Infof("creating user and policy for bucket %q", bktName)
 
-	// Create the user
+	// Create the user, tagged with the cluster and claim it belongs to,
+	// unless an interrupted attempt did. Its name is journaled first, so a
+	// crash right after creating it doesn't leak it: the next attempt
+	// resumes with it if its tags show it was created for this claim.
 	uname := p.bktUserName
-	_, err = p.iamsvc.CreateUser(&awsuser.CreateUserInput{
-		UserName: &uname,
+	tags := p.ownerTags(options)
+	resumed := p.journal != nil && p.journal.User == uname
+	exists := false
+	if resumed {
+		exists, err = p.checkIfUserExists(uname)
+		if err != nil {
+			return
+		}
+		if exists {
+			err = p.checkUserOwner(uname, options)
+			if err != nil {
+				// not ours to resume with or delete, generate a new user
+				// name on the next attempt
+				p.journal.forget(func(j *provisionJournal) { j.User = "" })
+				return
+			}
+		}
+	}
+	err = s.run("journal IAM user", func() error {
+		return p.journal.record(func(j *provisionJournal) { j.User = uname })
+	}, nil)
+	if err != nil {
+		return
+	}
+	err = s.run(fmt.Sprintf("create IAM user %q", uname), func() error {
+		if exists {
+			return nil
+		}
+		_, err := p.iamsvc.CreateUser(&awsuser.CreateUserInput{
+			UserName: &uname,
+			Path:     aws.String(p.iamPath()),
+			Tags:     iamTags(tags),
+		})
+		if isAWSErrorCode(err, awsuser.ErrCodeEntityAlreadyExistsException) {
+			// the name is taken by a user which isn't ours
+			p.journal.forget(func(j *provisionJournal) { j.User = "" })
+		}
+		return err
+	}, func() error {
+		_, err := p.iamsvc.DeleteUser(&awsuser.DeleteUserInput{UserName: &uname})
+		if err != nil && !isNoSuchEntityError(err) {
+			return err
+		}
+		p.journal.forget(func(j *provisionJournal) { j.User = "" })
+		return nil
 	})
 	if err != nil {
-		//should we fail here or keep going?
-		glog.Errorf("error creating IAM user %q: %v", uname, err)
 		return
 	}
-	// If something goes wrong after this point delete the IAM user
-	defer func() {
+
+	// The secret of the key created by an interrupted attempt is lost,
+	// replace it
+	if exists {
+		err = s.run(fmt.Sprintf("delete lost access keys of IAM user %q", uname), func() error {
+			return p.deleteAccessKeys(uname)
+		}, nil)
 		if err != nil {
-			_, delerr := p.iamsvc.DeleteUser(&awsuser.DeleteUserInput{UserName: &uname})
-			if delerr != nil {
-				glog.Errorf("Failed to undo creating IAM user %s: %v", uname, err)
-			}
+			return
 		}
-	}()
+	}
 
 	// Create an access key
-	userAccessId, userSecretKey, err = p.createAccessKey(uname)
+	err = s.run(fmt.Sprintf("create access key of IAM user %q", uname), func() (err error) {
+		userAccessId, userSecretKey, err = p.createAccessKey(uname)
+		return err
+	}, func() error {
+		_, err := p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{UserName: &uname, AccessKeyId: &userAccessId})
+		if err != nil && !isNoSuchEntityError(err) {
+			return err
+		}
+		p.journal.forget(func(j *provisionJournal) { j.AccessKeyID = "" })
+		return nil
+	})
 	if err != nil {
-		//should we fail here or keep going?
-		glog.Errorf("error creating IAM user %q: %v", uname, err)
 		return
 	}
-	// If something goes wrong after this point delete the IAM user
-	defer func() {
+	err = s.run("journal access key", func() error {
+		return p.journal.record(func(j *provisionJournal) { j.AccessKeyID = userAccessId })
+	}, nil)
+	if err != nil {
+		return
+	}
+
+	// Create the policy in aws for the user and bucket, unless an
+	// interrupted attempt did
+	// policyName is same as username
+	var policyArn string
+	err = s.run(fmt.Sprintf("create IAM policy %q", uname), func() error {
+		policyDoc, err := p.createBucketPolicyDocument(bktName, options)
 		if err != nil {
-			_, delerr := p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{UserName: &uname, AccessKeyId: &userAccessId})
-			if delerr != nil {
-				glog.Errorf("Failed to undo creating IAM user %s: %v", uname, err)
+			return err
+		}
+		if exists && p.journal.PolicyArn != "" {
+			_, err = p.iamsvc.GetPolicy(&awsuser.GetPolicyInput{PolicyArn: aws.String(p.journal.PolicyArn)})
+			if err == nil {
+				policyArn = p.journal.PolicyArn
+				return nil
+			}
+			if !isNoSuchEntityError(err) {
+				return err
 			}
 		}
-	}()
-
-	//Create the Policy for the user + bucket
-	//if createBucket was successful
-	//might change the input param into this function, we need bucketName
-	//and maybe accessPerms (read, write, read/write)
-	policyDoc, err := p.createBucketPolicyDocument(bktName, options)
+		out, err := p.createUserPolicy(p.iamsvc, uname, policyDoc, tags)
+		if err != nil {
+			return err
+		}
+		policyArn = aws.StringValue(out.Policy.Arn)
+		return nil
+	}, func() error {
+		// a policy can't be deleted while it's attached
+		_, err := p.iamsvc.DetachUserPolicy(&awsuser.DetachUserPolicyInput{PolicyArn: aws.String(policyArn), UserName: aws.String(uname)})
+		if err != nil && !isNoSuchEntityError(err) {
+			return err
+		}
+		_, err = p.iamsvc.DeletePolicy(&awsuser.DeletePolicyInput{PolicyArn: aws.String(policyArn)})
+		if err != nil && !isNoSuchEntityError(err) {
+			return err
+		}
+		p.journal.forget(func(j *provisionJournal) { j.PolicyArn = "" })
+		return nil
+	})
 	if err != nil {
-		//We did get our user created, but not our policy doc
-		//I'm going to pass back our user for now
-		glog.Errorf("error creating policyDoc %s: %v", bktName, err)
 		return
 	}
-
-	// Create the policy in aws for the user and bucket
-	// policyName is same as username
-	_, err = p.createUserPolicy(p.iamsvc, uname, policyDoc)
+	err = s.run("journal IAM policy", func() error {
+		return p.journal.record(func(j *provisionJournal) { j.PolicyArn = policyArn })
+	}, nil)
 	if err != nil {
-		//should we fail here or keep going?
-		glog.Errorf("error creating userPolicy for user %q on bucket %q: %v", uname, bktName, err)
 		return
 	}
-	// If something goes wrong after this point then delete policy document
-	defer func() {
-		if err != nil {
-			_, delerr := p.iamsvc.DeletePolicy(&awsuser.DeletePolicyInput{PolicyArn: aws.String(uname)})
-			if delerr != nil {
-				glog.Errorf("Failed to undo creating IAM policy %s: %v", uname, err)
-			}
-		}
-	}()
 
 	//attach policy to user - policyName and username are same
-	err = p.attachPolicyToUser(uname)
+	err = s.run(fmt.Sprintf("attach IAM policy %q to user", policyArn), func() error {
+		return p.attachPolicyToUser(uname)
+	}, func() error {
+		_, err := p.iamsvc.DetachUserPolicy(&awsuser.DetachUserPolicyInput{PolicyArn: aws.String(policyArn), UserName: aws.String(uname)})
+		if err != nil && !isNoSuchEntityError(err) {
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		glog.Errorf("error attaching userPolicy for user %q on bucket %q: %v", uname, bktName, err)
 		return
 	}
 
@@ -128,6 +207,11 @@ func (p *awsS3Provisioner) handleUserAndPolicy(bktName string, options *apibkt.B
 
 func (p *awsS3Provisioner) handleUserAndPolicyDeletion(bktName string) error {
 
+	// access granted by bucket policy is removed from the bucket policy
+	if p.bktPolicySid != "" {
+		return p.revokeBucketPolicyAccess(bktName)
+	}
+
 	if p.bktCreateUser != "yes" {
 		return nil
 	}
@@ -135,7 +219,6 @@ func (p *awsS3Provisioner) handleUserAndPolicyDeletion(bktName string) error {
 	glog.V(2).Infof("deleting user and policy for bucket %q", bktName)
 
 	uname := p.bktUserName
-	p.iamsvc = awsuser.New(p.iamSession)
 	arn := p.bktUserPolicyArn
 
 	// Detach Policy
@@ -154,16 +237,24 @@ func (p *awsS3Provisioner) handleUserAndPolicyDeletion(bktName string) error {
 	}
 	glog.V(2).Infof("successfully deleted policy %q", arn)
 
-	// Delete AccessKeys
+	// Delete AccessKeys, those recorded in the OB or, for OBs which
+	// predate recording them, the user's first key
 	// TODO: error handling
-	accessKeyId, _ := p.getAccessKey(uname)
-	if len(accessKeyId) != 0 {
+	accessKeyIds := strings.Split(p.bktUserAccessId, ",")
+	if p.bktUserAccessId == "" {
+		accessKeyId, _ := p.getAccessKey(uname)
+		accessKeyIds = []string{accessKeyId}
+	}
+	for _, accessKeyId := range accessKeyIds {
+		if len(accessKeyId) == 0 {
+			continue
+		}
 		_, err = p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{AccessKeyId: aws.String(accessKeyId), UserName: aws.String(uname)})
 		if err != nil && !isNoSuchEntityError(err) {
 			glog.Errorf("Error deleting access key for user %s %v", uname, err)
 			return err
 		}
-		glog.V(2).Infof("successfully deleted access key for user %q", uname)
+		glog.V(2).Infof("successfully deleted access key %q for user %q", accessKeyId, uname)
 	}
 
 	// Delete IAM User
@@ -184,6 +275,30 @@ func (p *awsS3Provisioner) createBucketPolicyDocument(bktName string, options *a
 	p.bktUserPolicyArn = arn
 	glog.V(2).Infof("createBucketPolicyDocument for bucket %q and ARN %q", bktName, arn)
 
+	policy := PolicyDocument{
+		Version: "2012-10-17",
+	}
+	stmts, err := policyStatements(bktName, options)
+	if err != nil {
+		return "", err
+	}
+	policy.Statement = stmts
+
+	b, err := json.MarshalIndent(&policy, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshaling policy, %s", err.Error())
+	}
+
+	return string(b), nil
+}
+
+// policyStatements returns the permission statements granting access to
+// bktName, either the default read+write statements or those from the
+// storage class's "iamPolicy", each limited to just this bucket.
+func policyStatements(bktName string, options *apibkt.BucketOptions) ([]StatementEntry, error) {
+
+	arn := fmt.Sprintf(s3BucketArn, bktName)
+
 	read := StatementEntry{
 		Sid:    "s3Read",
 		Effect: "Allow",
@@ -261,7 +376,7 @@ func (p *awsS3Provisioner) createBucketPolicyDocument(bktName string, options *a
 	if p, ok := options.Parameters["iamPolicy"]; ok {
 		err := json.Unmarshal([]byte(p), &policy)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		// Ensure each policy is tied to just this bucket
 		for idx := range policy.Statement {
@@ -281,32 +396,29 @@ func (p *awsS3Provisioner) createBucketPolicyDocument(bktName string, options *a
 				case storageV1.ReadWritePermission:
 					policy.Statement = append(policy.Statement, read, write)
 				default:
-					return "", fmt.Errorf("unknown permission, %s", *spec.LocalPermission)
+					return nil, fmt.Errorf("unknown permission, %s", *spec.LocalPermission)
 				}
 			}
 		*/
 		policy.Statement = append(policy.Statement, read, write)
 	}
 
-	b, err := json.MarshalIndent(&policy, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("error marshaling policy, %s", err.Error())
-	}
-
-	return string(b), nil
+	return policy.Statement, nil
 }
 
-func (p awsS3Provisioner) createUserPolicy(iamsvc *awsuser.IAM, policyName string, policyDocument string) (*awsuser.CreatePolicyOutput, error) {
+func (p awsS3Provisioner) createUserPolicy(iamsvc iamiface.IAMAPI, policyName string, policyDocument string, tags map[string]string) (*awsuser.CreatePolicyOutput, error) {
 
 	policyInput := &awsuser.CreatePolicyInput{
 		PolicyName:     aws.String(policyName),
 		PolicyDocument: aws.String(policyDocument),
+		Path:           aws.String(p.iamPath()),
+		Description:    aws.String(tagsDescription(tags)),
 	}
 
 	result, err := iamsvc.CreatePolicy(policyInput)
 	if err != nil {
-		fmt.Println("Error", err)
-		return nil, err
+		glog.Errorf("error creating policy %q: %v", policyName, err)
+		return nil, fmt.Errorf("error creating policy %q: %v", policyName, err)
 	}
 
 	glog.V(2).Infof("createUserPolicy %q successfully created", policyName)
@@ -323,7 +435,7 @@ func (p *awsS3Provisioner) getPolicyARN(policyName string) (string, error) {
 
 	// set the accountID in our provisioner
 	p.bktUserAccountId = accountID
-	policyARN := fmt.Sprintf(policyArn, accountID, policyName)
+	policyARN := fmt.Sprintf(policyArn, accountID, p.iamPath(), policyName)
 	// set the policyARN for our provisioner
 	p.bktUserPolicyArn = policyARN
 	glog.V(2).Infof("successfully got PolicyARN %q for AccountID %s's Policy %q", policyARN, accountID, policyName)
@@ -384,6 +496,22 @@ func (p *awsS3Provisioner) createAccessKey(user string) (string, string, error)
 	return acccessId, secretKey, nil
 }
 
+// deleteAccessKeys deletes all the access keys of the user.
+func (p *awsS3Provisioner) deleteAccessKeys(uname string) error {
+
+	keys, err := p.iamsvc.ListAccessKeys(&awsuser.ListAccessKeysInput{UserName: aws.String(uname)})
+	if err != nil {
+		return fmt.Errorf("error listing access keys of user %q: %v", uname, err)
+	}
+	for _, k := range keys.AccessKeyMetadata {
+		_, err = p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{AccessKeyId: k.AccessKeyId, UserName: aws.String(uname)})
+		if err != nil && !isNoSuchEntityError(err) {
+			return fmt.Errorf("error deleting access key %q of user %q: %v", aws.StringValue(k.AccessKeyId), uname, err)
+		}
+	}
+	return nil
+}
+
 // getAccessKeyId - Gets the accountID of the authenticated session.
 func (p *awsS3Provisioner) getAccessKey(username string) (string, error) {
 
@@ -419,3 +547,83 @@ func (p *awsS3Provisioner) setCreateBucketUserOptions(sc *storageV1.StorageClass
 	glog.V(2).Infof("storage class flag %s's value, or absence of flag, indicates to create a new user", scBucketUser)
 	p.bktCreateUser = "yes"
 }
+
+// check storage class params for bucketPolicyAccess and set
+// provisioner receiver field.
+func (p *awsS3Provisioner) setBucketPolicyAccessOptions(sc *storageV1.StorageClass) {
+
+	const scBucketPolicy = "bucketPolicyAccess"
+
+	// get sc bucket policy flag parameter
+	p.bktPolicyAccess = sc.Parameters[scBucketPolicy] == "yes"
+	if p.bktPolicyAccess {
+		glog.V(2).Infof("storage class flag %q indicates to grant access using the bucket policy", scBucketPolicy)
+	}
+}
+
+// deleteIAMUser detaches all policies from the user, deletes all its access
+// keys and then the user itself. A user which no longer exists is not an error.
+func (p *awsS3Provisioner) deleteIAMUser(uname string) error {
+
+	glog.V(2).Infof("deleting IAM user %q", uname)
+	err := p.iamsvc.ListAttachedUserPoliciesPages(&awsuser.ListAttachedUserPoliciesInput{UserName: aws.String(uname)},
+		func(out *awsuser.ListAttachedUserPoliciesOutput, last bool) bool {
+			for _, policy := range out.AttachedPolicies {
+				_, err := p.iamsvc.DetachUserPolicy(&awsuser.DetachUserPolicyInput{PolicyArn: policy.PolicyArn, UserName: aws.String(uname)})
+				if err != nil && !isNoSuchEntityError(err) {
+					glog.Errorf("Error detaching policy %s from user %s: %v", aws.StringValue(policy.PolicyArn), uname, err)
+				}
+			}
+			return true
+		})
+	if err != nil && !isNoSuchEntityError(err) {
+		return err
+	}
+
+	keys, err := p.iamsvc.ListAccessKeys(&awsuser.ListAccessKeysInput{UserName: aws.String(uname)})
+	if err != nil && !isNoSuchEntityError(err) {
+		return err
+	}
+	if keys != nil {
+		for _, key := range keys.AccessKeyMetadata {
+			_, err = p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(uname)})
+			if err != nil && !isNoSuchEntityError(err) {
+				return err
+			}
+		}
+	}
+
+	_, err = p.iamsvc.DeleteUser(&awsuser.DeleteUserInput{UserName: aws.String(uname)})
+	if err != nil && !isNoSuchEntityError(err) {
+		return err
+	}
+	glog.V(2).Infof("successfully deleted IAM user %q", uname)
+	return nil
+}
+
+// deleteIAMPolicy detaches the policy from all users and deletes it.
+// A policy which no longer exists is not an error.
+func (p *awsS3Provisioner) deleteIAMPolicy(arn string) error {
+
+	glog.V(2).Infof("deleting IAM policy %q", arn)
+	err := p.iamsvc.ListEntitiesForPolicyPages(&awsuser.ListEntitiesForPolicyInput{PolicyArn: aws.String(arn)},
+		func(out *awsuser.ListEntitiesForPolicyOutput, last bool) bool {
+			for _, user := range out.PolicyUsers {
+				_, err := p.iamsvc.DetachUserPolicy(&awsuser.DetachUserPolicyInput{PolicyArn: aws.String(arn), UserName: user.UserName})
+				if err != nil && !isNoSuchEntityError(err) {
+					glog.Errorf("Error detaching policy %s from user %s: %v", arn, aws.StringValue(user.UserName), err)
+				}
+			}
+			return true
+		})
+	if err != nil && !isNoSuchEntityError(err) {
+		return err
+	}
+
+	_, err = p.iamsvc.DeletePolicy(&awsuser.DeletePolicyInput{PolicyArn: aws.String(arn)})
+	if err != nil && !isNoSuchEntityError(err) {
+		return err
+	}
+	glog.V(2).Infof("successfully deleted IAM policy %q", arn)
+	return nil
+}
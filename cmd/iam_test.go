@@ -0,0 +1,233 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHandleUserAndPolicyJournal(t *testing.T) {
+
+	const (
+		uname = "ns-claim-abcde"
+		uid   = "uid-1"
+	)
+	arn := fmt.Sprintf(policyArn, fakeAccountID, "/obc/cluster-a/", uname)
+	userTags := func(cluster, uid string) map[string]string {
+		return map[string]string{tagClusterID: cluster, tagProvisioner: provisionerName, tagOBCUID: uid}
+	}
+
+	tests := []struct {
+		name string
+		// IAM state left by an interrupted attempt, and the journal of it
+		setup   func(f *fakeIAM)
+		journal provisionJournal
+		fail    map[string]error
+		wantErr bool
+		// state once done, or undone on failure
+		wantUser    bool
+		wantKeys    []string
+		wantPolicy  bool
+		wantJournal provisionJournal
+		// calls expected in this order, and calls not expected
+		wantCalls []string
+		notCalled []string
+	}{
+		{
+			name:        "new user",
+			wantUser:    true,
+			wantKeys:    []string{"AKID1"},
+			wantPolicy:  true,
+			wantJournal: provisionJournal{User: uname, AccessKeyID: "AKID1", PolicyArn: arn},
+			wantCalls:   []string{"CreateUser " + uname, "CreateAccessKey " + uname, "CreatePolicy " + uname, "AttachUserPolicy " + arn},
+			notCalled:   []string{"ListUserTags", "DeleteAccessKey"},
+		},
+		{
+			name: "resumed with journaled user, key and policy",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-a", uid)
+				f.keys[uname] = []string{"AKID-lost"}
+				f.policies[arn] = true
+			},
+			journal:     provisionJournal{User: uname, AccessKeyID: "AKID-lost", PolicyArn: arn},
+			wantUser:    true,
+			wantKeys:    []string{"AKID1"},
+			wantPolicy:  true,
+			wantJournal: provisionJournal{User: uname, AccessKeyID: "AKID1", PolicyArn: arn},
+			wantCalls:   []string{"ListUserTags " + uname, "DeleteAccessKey AKID-lost", "CreateAccessKey " + uname, "GetPolicy " + arn, "AttachUserPolicy " + arn},
+			notCalled:   []string{"CreateUser", "CreatePolicy"},
+		},
+		{
+			name: "resumed with journaled policy deleted meanwhile",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-a", uid)
+			},
+			journal:     provisionJournal{User: uname, PolicyArn: arn},
+			wantUser:    true,
+			wantKeys:    []string{"AKID1"},
+			wantPolicy:  true,
+			wantJournal: provisionJournal{User: uname, AccessKeyID: "AKID1", PolicyArn: arn},
+			wantCalls:   []string{"GetPolicy " + arn, "CreatePolicy " + uname},
+			notCalled:   []string{"CreateUser"},
+		},
+		{
+			name:        "resumed with journaled user deleted meanwhile",
+			journal:     provisionJournal{User: uname},
+			wantUser:    true,
+			wantKeys:    []string{"AKID1"},
+			wantPolicy:  true,
+			wantJournal: provisionJournal{User: uname, AccessKeyID: "AKID1", PolicyArn: arn},
+			wantCalls:   []string{"GetUser " + uname, "CreateUser " + uname},
+			notCalled:   []string{"ListUserTags", "DeleteAccessKey"},
+		},
+		{
+			name: "journaled user of another claim",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-a", "uid-2")
+				f.keys[uname] = []string{"AKID-other"}
+			},
+			journal:   provisionJournal{User: uname},
+			wantErr:   true,
+			wantUser:  true,
+			wantKeys:  []string{"AKID-other"},
+			notCalled: []string{"CreateUser", "DeleteUser", "DeleteAccessKey", "CreateAccessKey"},
+		},
+		{
+			name: "journaled user of another cluster",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-b", uid)
+			},
+			journal:   provisionJournal{User: uname},
+			wantErr:   true,
+			wantUser:  true,
+			notCalled: []string{"CreateUser", "DeleteUser", "CreateAccessKey"},
+		},
+		{
+			name: "user name taken by another claim isn't kept",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-b", "uid-2")
+			},
+			wantErr:   true,
+			wantUser:  true,
+			wantCalls: []string{"CreateUser " + uname},
+			notCalled: []string{"DeleteUser", "CreateAccessKey"},
+		},
+		{
+			// the user may have been created despite the error
+			name:        "user journaled before it's created",
+			fail:        map[string]error{"CreateUser": awserr.New(awsuser.ErrCodeServiceFailureException, "timeout", nil)},
+			wantErr:     true,
+			wantJournal: provisionJournal{User: uname},
+			wantCalls:   []string{"CreateUser " + uname},
+			notCalled:   []string{"DeleteUser", "CreateAccessKey"},
+		},
+		{
+			name:      "attach failing undoes in reverse",
+			fail:      map[string]error{"AttachUserPolicy": awserr.New(awsuser.ErrCodeServiceFailureException, "unavailable", nil)},
+			wantErr:   true,
+			wantCalls: []string{"AttachUserPolicy " + arn, "DetachUserPolicy " + arn, "DeletePolicy " + arn, "DeleteAccessKey AKID1", "DeleteUser " + uname},
+		},
+		{
+			name: "resumed user is deleted when failing",
+			setup: func(f *fakeIAM) {
+				f.users[uname] = userTags("cluster-a", uid)
+				f.keys[uname] = []string{"AKID-lost"}
+			},
+			journal:   provisionJournal{User: uname, AccessKeyID: "AKID-lost"},
+			fail:      map[string]error{"CreatePolicy": awserr.New(awsuser.ErrCodeLimitExceededException, "too many policies", nil)},
+			wantErr:   true,
+			wantCalls: []string{"DeleteAccessKey AKID-lost", "CreateAccessKey " + uname, "CreatePolicy " + uname, "DeleteAccessKey AKID1", "DeleteUser " + uname},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeIAM()
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			if tt.fail != nil {
+				f.fail = tt.fail
+			}
+			obc := &v1alpha1.ObjectBucketClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "claim", UID: uid}}
+			c := fake.NewSimpleClientset()
+			j := tt.journal
+			j.clientset, j.obc = c, obc
+			if err := j.save(); err != nil {
+				t.Fatalf("saving journal: %v", err)
+			}
+			p := &awsS3Provisioner{
+				clusterID:     "cluster-a",
+				iamPathPrefix: "/obc/",
+				iamsvc:        f,
+				bktUserName:   uname,
+				journal:       &j,
+			}
+
+			s := newSaga("provision bucket")
+			_, _, err := p.handleUserAndPolicy(s, "bkt", &apibkt.BucketOptions{ObjectBucketClaim: obc})
+			if err != nil {
+				err = p.abort(s, err)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handleUserAndPolicy() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if _, ok := f.users[uname]; ok != tt.wantUser {
+				t.Errorf("user exists = %v, want %v", ok, tt.wantUser)
+			}
+			if keys := f.keys[uname]; len(keys)+len(tt.wantKeys) > 0 && !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("access keys = %v, want %v", keys, tt.wantKeys)
+			}
+			if f.policies[arn] != tt.wantPolicy {
+				t.Errorf("policy exists = %v, want %v", f.policies[arn], tt.wantPolicy)
+			}
+			saved, err := loadJournal(c, obc)
+			if err != nil {
+				t.Fatalf("loading journal: %v", err)
+			}
+			got := provisionJournal{User: saved.User, AccessKeyID: saved.AccessKeyID, PolicyArn: saved.PolicyArn}
+			if got != tt.wantJournal {
+				t.Errorf("journal = %+v, want %+v", got, tt.wantJournal)
+			}
+
+			next := 0
+			for _, call := range f.calls {
+				if next < len(tt.wantCalls) && call == tt.wantCalls[next] {
+					next++
+				}
+				for _, not := range tt.notCalled {
+					if strings.HasPrefix(call, not+" ") {
+						t.Errorf("unexpected call %q", call)
+					}
+				}
+			}
+			if next < len(tt.wantCalls) {
+				t.Errorf("calls %q, want in order %q", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
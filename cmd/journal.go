@@ -0,0 +1,230 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// suffix of the name of the ConfigMap holding a claim's journal
+	journalSuffix = "-provision-journal"
+	// ConfigMap key of the journal
+	journalKey = "journal"
+)
+
+// provisionJournal records what a Provision or Grant created so far, so a
+// retry after a crash resumes with the same bucket, user and policy rather
+// than failing on the bucket or leaking the user. It's kept in a ConfigMap
+// owned by the claim: the bucket library updates the claim with the copy it
+// read before provisioning, so the claim itself can't change meanwhile.
+type provisionJournal struct {
+	// bucket created for the claim
+	Bucket string `json:"bucket,omitempty"`
+	// IAM user, recorded before it's created
+	User string `json:"user,omitempty"`
+	// access key of the user
+	AccessKeyID string `json:"accessKeyId,omitempty"`
+	// IAM policy of the user
+	PolicyArn string `json:"policyArn,omitempty"`
+
+	clientset kubernetes.Interface
+	obc       *v1alpha1.ObjectBucketClaim
+}
+
+func journalName(obc *v1alpha1.ObjectBucketClaim) string {
+	return obc.Name + journalSuffix
+}
+
+// loadJournal returns the claim's journal, empty if there's none.
+func loadJournal(c kubernetes.Interface, obc *v1alpha1.ObjectBucketClaim) (*provisionJournal, error) {
+
+	j := &provisionJournal{clientset: c, obc: obc}
+	cm, err := c.CoreV1().ConfigMaps(obc.Namespace).Get(journalName(obc), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting provisioning journal of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	err = json.Unmarshal([]byte(cm.Data[journalKey]), j)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provisioning journal of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	glog.Infof("found provisioning journal of OBC \"%s/%s\": %s", obc.Namespace, obc.Name, cm.Data[journalKey])
+	return j, nil
+}
+
+// record updates the journal with f and saves it. A nil journal, outside of
+// provisioning, records nothing.
+func (j *provisionJournal) record(f func(j *provisionJournal)) error {
+	if j == nil {
+		return nil
+	}
+	f(j)
+	return j.save()
+}
+
+// forget updates the journal with f without saving it, for compensations
+// whose outcome is saved when provisioning fails.
+func (j *provisionJournal) forget(f func(j *provisionJournal)) {
+	if j != nil {
+		f(j)
+	}
+}
+
+// empty returns true if nothing is left to resume or undo.
+func (j *provisionJournal) empty() bool {
+	return j.Bucket == "" && j.User == "" && j.AccessKeyID == "" && j.PolicyArn == ""
+}
+
+// save writes the journal to its ConfigMap, deleting the ConfigMap once
+// the journal is empty.
+func (j *provisionJournal) save() error {
+
+	if j == nil {
+		return nil
+	}
+	if j.empty() {
+		return clearJournal(j.clientset, j.obc)
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	obc := j.obc
+	cms := j.clientset.CoreV1().ConfigMaps(obc.Namespace)
+	cm, err := cms.Get(journalName(obc), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      journalName(obc),
+				Namespace: obc.Namespace,
+				// the journal goes with its claim
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: v1alpha1.SchemeGroupVersion.String(),
+					Kind:       v1alpha1.ObjectBucketClaimGVK().Kind,
+					Name:       obc.Name,
+					UID:        obc.UID,
+				}},
+			},
+			Data: map[string]string{journalKey: string(b)},
+		}
+		_, err = cms.Create(cm)
+	} else if err == nil {
+		cm.Data = map[string]string{journalKey: string(b)}
+		_, err = cms.Update(cm)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving provisioning journal of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	return nil
+}
+
+// clearJournal deletes the claim's journal, if any.
+func clearJournal(c kubernetes.Interface, obc *v1alpha1.ObjectBucketClaim) error {
+
+	err := c.CoreV1().ConfigMaps(obc.Namespace).Delete(journalName(obc), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting provisioning journal of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	return nil
+}
+
+// settleJournal deletes what the claim's journal records but its OB
+// doesn't reference, left behind by compensations which failed, and then
+// the journal. Entities which can't be deleted are logged and kept in the
+// journal for the next reconcile. Buckets are only reported, as they may
+// hold data.
+func (p *awsS3Provisioner) settleJournal(obc *v1alpha1.ObjectBucketClaim, ob *v1alpha1.ObjectBucket) error {
+
+	j, err := loadJournal(p.clientset, obc)
+	if err != nil || j.empty() {
+		return err
+	}
+	state := ob.Spec.AdditionalState
+	keys := map[string]bool{}
+	for _, id := range strings.Split(state[obStateAccessKeys], ",") {
+		keys[id] = true
+	}
+	leak := func(what string, err error) {
+		glog.Errorf("reconciler: error deleting %s journaled for OBC \"%s/%s\", manual clean up may be required: %v",
+			what, obc.Namespace, obc.Name, err)
+	}
+
+	if j.Bucket != "" && j.Bucket != p.bucketName {
+		glog.Warningf("reconciler: bucket %q journaled for OBC \"%s/%s\" isn't its bucket, it's left as it is",
+			j.Bucket, obc.Namespace, obc.Name)
+	}
+	j.Bucket = ""
+
+	if j.PolicyArn != "" && j.PolicyArn != state[obStateARN] {
+		if err = p.deleteIAMPolicy(j.PolicyArn); err != nil {
+			leak(fmt.Sprintf("IAM policy %q", j.PolicyArn), err)
+		} else {
+			j.PolicyArn = ""
+		}
+	} else {
+		j.PolicyArn = ""
+	}
+
+	// a user the OB doesn't reference goes with its access keys, unless
+	// it turns out not to be the claim's
+	if j.User != "" && j.User != state[obStateUser] {
+		exists, err := p.checkIfUserExists(j.User)
+		if err == nil && exists {
+			if oerr := p.checkUserOwner(j.User, &apibkt.BucketOptions{ObjectBucketClaim: obc}); oerr != nil {
+				glog.Warningf("reconciler: not deleting user journaled for OBC \"%s/%s\": %v", obc.Namespace, obc.Name, oerr)
+			} else {
+				err = p.deleteIAMUser(j.User)
+			}
+		}
+		if err != nil {
+			leak(fmt.Sprintf("IAM user %q", j.User), err)
+		} else {
+			j.User, j.AccessKeyID = "", ""
+		}
+	} else if j.AccessKeyID != "" && !keys[j.AccessKeyID] && j.User != "" {
+		// a key of the claim's user replaced by a later attempt
+		_, err = p.iamsvc.DeleteAccessKey(&awsuser.DeleteAccessKeyInput{
+			AccessKeyId: aws.String(j.AccessKeyID),
+			UserName:    aws.String(j.User),
+		})
+		if err != nil && !isNoSuchEntityError(err) {
+			leak(fmt.Sprintf("access key %q", j.AccessKeyID), err)
+		} else {
+			j.User, j.AccessKeyID = "", ""
+		}
+	} else {
+		j.User, j.AccessKeyID = "", ""
+	}
+
+	return j.save()
+}
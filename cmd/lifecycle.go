@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// lifecycle rule list, in JSON or YAML, using the field names of the
+	// S3 LifecycleRule type
+	cfgLifecycle = "lifecycle"
+	// shorthand keys, each adding a rule applying to the whole bucket
+	cfgExpireAfterDays           = "expireAfterDays"
+	cfgNoncurrentExpireAfterDays = "noncurrentExpireAfterDays"
+	cfgAbortMultipartDays        = "abortIncompleteMultipartDays"
+)
+
+// getLifecycleRules returns the lifecycle rules from the storage class
+// parameters and the OBC, or nil if none are configured.
+func getLifecycleRules(params map[string]string, obc *v1alpha1.ObjectBucketClaim) ([]*s3.LifecycleRule, error) {
+
+	var rules []*s3.LifecycleRule
+	if v := configValue(params, obc, cfgLifecycle); v != "" {
+		b, err := yaml.YAMLToJSON([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", cfgLifecycle, err)
+		}
+		err = json.Unmarshal(b, &rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", cfgLifecycle, err)
+		}
+	}
+
+	// add a whole bucket rule for each shorthand key
+	for _, key := range []string{cfgExpireAfterDays, cfgNoncurrentExpireAfterDays, cfgAbortMultipartDays} {
+		v := configValue(params, obc, key)
+		if v == "" {
+			continue
+		}
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a positive number of days", key, v)
+		}
+		rule := &s3.LifecycleRule{ID: aws.String(key)}
+		switch key {
+		case cfgExpireAfterDays:
+			rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(days)}
+		case cfgNoncurrentExpireAfterDays:
+			rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(days)}
+		case cfgAbortMultipartDays:
+			rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(days)}
+		}
+		rules = append(rules, rule)
+	}
+
+	ids := map[string]bool{}
+	for i, rule := range rules {
+		// default to enabled rules applying to the whole bucket
+		if rule.Status == nil {
+			rule.Status = aws.String(s3.ExpirationStatusEnabled)
+		}
+		if rule.Filter == nil && rule.Prefix == nil {
+			rule.Filter = &s3.LifecycleRuleFilter{Prefix: aws.String("")}
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid lifecycle rule %d: %v", i, err)
+		}
+		id := aws.StringValue(rule.ID)
+		if id != "" && ids[id] {
+			return nil, fmt.Errorf("duplicate lifecycle rule ID %q", id)
+		}
+		ids[id] = true
+	}
+	return rules, nil
+}
+
+// applyLifecycle replaces the bucket's lifecycle configuration with rules,
+// or deletes it if there are none.
+func (p *awsS3Provisioner) applyLifecycle(bktName string, rules []*s3.LifecycleRule) error {
+
+	if len(rules) == 0 {
+		glog.V(2).Infof("removing lifecycle rules of bucket %q", bktName)
+		_, err := p.s3svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: aws.String(bktName)})
+		if err != nil {
+			return fmt.Errorf("error removing lifecycle rules of bucket %q: %v", bktName, err)
+		}
+		return nil
+	}
+
+	glog.V(2).Infof("setting %d lifecycle rules on bucket %q", len(rules), bktName)
+	_, err := p.s3svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bktName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting lifecycle rules of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
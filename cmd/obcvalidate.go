@@ -0,0 +1,157 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	storageV1 "k8s.io/api/storage/v1"
+)
+
+const (
+	// storage class parameter listing the namespaces whose claims may use
+	// it, names or prefixes ending in "*"
+	scAllowedNamespaces = "allowedNamespaces"
+
+	minBucketNameLen = 3
+	maxBucketNameLen = 63
+)
+
+var (
+	// bucketNameRegexp matches the characters allowed in S3 bucket names
+	bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+	// bucketPrefixRegexp matches the generateBucketName prefixes, which the
+	// bucket library follows with "-" and a uuid
+	bucketPrefixRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+)
+
+// validBucketName checks the name against the S3 bucket naming rules.
+func validBucketName(name string) error {
+
+	if len(name) < minBucketNameLen || len(name) > maxBucketNameLen {
+		return fmt.Errorf("bucket name %q must be %d to %d characters long", name, minBucketNameLen, maxBucketNameLen)
+	}
+	if !bucketNameRegexp.MatchString(name) {
+		return fmt.Errorf("bucket name %q may only contain lowercase letters, digits, dots and hyphens, "+
+			"and must begin and end with a letter or digit", name)
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, ".-") || strings.Contains(name, "-.") {
+		return fmt.Errorf("bucket name %q must not contain adjacent dots or a dot next to a hyphen", name)
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("bucket name %q must not be formatted as an IP address", name)
+	}
+	return nil
+}
+
+// validBucketPrefix checks a generateBucketName prefix.
+func validBucketPrefix(prefix string) error {
+
+	if !bucketPrefixRegexp.MatchString(prefix) || strings.Contains(prefix, "..") ||
+		strings.Contains(prefix, ".-") || strings.HasSuffix(prefix, ".") {
+		return fmt.Errorf("generateBucketName %q is not a valid bucket name prefix, it may only contain lowercase "+
+			"letters, digits, dots and hyphens, and must begin with a letter or digit", prefix)
+	}
+	return nil
+}
+
+// namespaceAllowed returns true if the storage class may be used by claims
+// in the namespace.
+func namespaceAllowed(params map[string]string, ns string) bool {
+
+	allowed, ok := params[scAllowedNamespaces]
+	if !ok {
+		return true
+	}
+	for _, pattern := range strings.Split(allowed, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == ns || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(ns, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClaim checks an OBC using the storage class: the bucket name,
+// its namespace and its additionalConfig keys and values. For updates, old
+// is the claim being updated and only the fields changed are checked.
+func validateClaim(sc *storageV1.StorageClass, obc, old *v1alpha1.ObjectBucketClaim) error {
+
+	errs := []string{}
+	if old == nil || old.Spec.StorageClassName != obc.Spec.StorageClassName {
+		if !namespaceAllowed(sc.Parameters, obc.Namespace) {
+			errs = append(errs, fmt.Sprintf("storage class %q can't be used in namespace %q", sc.Name, obc.Namespace))
+		}
+	}
+
+	// claims of existing buckets get the storage class's bucket name
+	if sc.Parameters[v1alpha1.StorageClassBucket] == "" && bucketNameChanged(obc, old) {
+		if obc.Spec.BucketName != "" {
+			if err := validBucketName(obc.Spec.BucketName); err != nil {
+				errs = append(errs, err.Error())
+			}
+		} else if obc.Spec.GenerateBucketName != "" {
+			if err := validBucketPrefix(obc.Spec.GenerateBucketName); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if old == nil || !reflect.DeepEqual(old.Spec.AdditionalConfig, obc.Spec.AdditionalConfig) {
+		allowed := claimOverrides(sc.Parameters)
+		keys := []string{}
+		for key := range obc.Spec.AdditionalConfig {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !allowed[key] {
+				errs = append(errs, fmt.Sprintf("additionalConfig key %q isn't allowed by storage class %q", key, sc.Name))
+			}
+		}
+		if _, err := getBucketConfig(sc.Parameters, obc); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid claim: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// bucketNameChanged returns true if the claim's bucket name or prefix is
+// new or changed, other than by the bucket library filling in the name it
+// generated from the prefix.
+func bucketNameChanged(obc, old *v1alpha1.ObjectBucketClaim) bool {
+
+	if old == nil || old.Spec.GenerateBucketName != obc.Spec.GenerateBucketName {
+		return true
+	}
+	if old.Spec.BucketName == obc.Spec.BucketName {
+		return false
+	}
+	generated := old.Spec.BucketName == "" && obc.Spec.GenerateBucketName != "" &&
+		strings.HasPrefix(obc.Spec.BucketName, obc.Spec.GenerateBucketName+"-")
+	return !generated
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	storageV1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newClaim returns a claim of the "s3" storage class in the namespace.
+func newClaim(ns string, spec v1alpha1.ObjectBucketClaimSpec) *v1alpha1.ObjectBucketClaim {
+	spec.StorageClassName = "s3"
+	return &v1alpha1.ObjectBucketClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "claim"},
+		Spec:       spec,
+	}
+}
+
+func TestValidateClaim(t *testing.T) {
+
+	sc := &storageV1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "s3"},
+		Parameters: map[string]string{
+			scAllowedNamespaces: "apps, team-*",
+			scClaimOverrides:    cfgVersioning,
+		},
+	}
+	brownfield := &storageV1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "s3"},
+		Parameters: map[string]string{v1alpha1.StorageClassBucket: "shared"},
+	}
+	named := func(ns, name string) *v1alpha1.ObjectBucketClaim {
+		return newClaim(ns, v1alpha1.ObjectBucketClaimSpec{BucketName: name})
+	}
+	config := func(ns string, cfg map[string]string) *v1alpha1.ObjectBucketClaim {
+		return newClaim(ns, v1alpha1.ObjectBucketClaimSpec{GenerateBucketName: "data", AdditionalConfig: cfg})
+	}
+
+	tests := []struct {
+		name     string
+		sc       *storageV1.StorageClass
+		obc, old *v1alpha1.ObjectBucketClaim
+		// substrings of the error, none if valid
+		wantErr []string
+	}{
+		{"valid name", sc, named("apps", "my-bucket.1"), nil, nil},
+		{"valid prefix", sc, newClaim("team-a", v1alpha1.ObjectBucketClaimSpec{GenerateBucketName: "data"}), nil, nil},
+		{"namespace not allowed", sc, named("other", "my-bucket"), nil, []string{`namespace "other"`}},
+		{"name too short", sc, named("apps", "ab"), nil, []string{"3 to 63 characters"}},
+		{"name with uppercase", sc, named("apps", "My-Bucket"), nil, []string{"lowercase"}},
+		{"name with adjacent dots", sc, named("apps", "my..bucket"), nil, []string{"adjacent dots"}},
+		{"name formatted as an IP", sc, named("apps", "192.168.1.1"), nil, []string{"IP address"}},
+		{"invalid prefix", sc, newClaim("apps", v1alpha1.ObjectBucketClaimSpec{GenerateBucketName: "Data"}), nil, []string{"generateBucketName"}},
+		{"any name for an existing bucket", brownfield, named("apps", "X"), nil, nil},
+		{"allowed override", sc, config("apps", map[string]string{cfgVersioning: "Enabled"}), nil, nil},
+		{"override not allowed", sc, config("apps", map[string]string{cfgExpireAfterDays: "3"}), nil, []string{`key "expireAfterDays" isn't allowed`}},
+		{"invalid override value", sc, config("apps", map[string]string{cfgVersioning: "on"}), nil, []string{cfgVersioning}},
+		{
+			"all problems reported", sc,
+			newClaim("other", v1alpha1.ObjectBucketClaimSpec{BucketName: "Bkt", AdditionalConfig: map[string]string{"x": "y"}}), nil,
+			[]string{"namespace", "lowercase", `key "x"`},
+		},
+		// updates only check what they change
+		{"update in a namespace no longer allowed", sc, config("other", map[string]string{cfgVersioning: "Enabled"}), config("other", nil), nil},
+		{"update of an invalid name", sc, named("apps", "Bkt2"), named("apps", "Bkt1"), []string{"lowercase"}},
+		{"update removing an override", sc, config("apps", nil), config("apps", map[string]string{cfgVersioning: "Enabled"}), nil},
+		{
+			"update keeping an override no longer allowed", sc,
+			newClaim("apps", v1alpha1.ObjectBucketClaimSpec{BucketName: "new-bucket", AdditionalConfig: map[string]string{"x": "y"}}),
+			newClaim("apps", v1alpha1.ObjectBucketClaimSpec{BucketName: "old-bucket", AdditionalConfig: map[string]string{"x": "y"}}),
+			nil,
+		},
+		{"update adding an override not allowed", sc, config("apps", map[string]string{"x": "y"}), config("apps", nil), []string{`key "x"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClaim(tt.sc, tt.obc, tt.old)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("validateClaim() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateClaim() error = nil, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateClaim() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketNameChanged(t *testing.T) {
+
+	claim := func(prefix, name string) *v1alpha1.ObjectBucketClaim {
+		return newClaim("ns", v1alpha1.ObjectBucketClaimSpec{GenerateBucketName: prefix, BucketName: name})
+	}
+
+	tests := []struct {
+		name     string
+		obc, old *v1alpha1.ObjectBucketClaim
+		want     bool
+	}{
+		{"created", claim("data", ""), nil, true},
+		{"unchanged", claim("", "bkt"), claim("", "bkt"), false},
+		{"name changed", claim("", "bkt2"), claim("", "bkt"), true},
+		{"prefix changed", claim("logs", ""), claim("data", ""), true},
+		{"name generated from the prefix", claim("data", "data-1234"), claim("data", ""), false},
+		{"name not from the prefix", claim("data", "logs-1234"), claim("data", ""), true},
+		{"generated name changed", claim("data", "data-5678"), claim("data", "data-1234"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketNameChanged(tt.obc, tt.old); got != tt.want {
+				t.Errorf("bucketNameChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
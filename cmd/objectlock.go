@@ -0,0 +1,139 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+)
+
+const (
+	// bucket configuration keys
+	cfgObjectLock         = "objectLock"
+	cfgRetentionMode      = "objectLockRetentionMode"
+	cfgRetentionDays      = "objectLockRetentionDays"
+	cfgRetentionYears     = "objectLockRetentionYears"
+	errNoObjectLockConfig = "ObjectLockConfigurationNotFoundError"
+)
+
+// getObjectLockConfig validates and sets the object lock settings of cfg.
+func getObjectLockConfig(cfg *bucketConfig, params map[string]string, obc *v1alpha1.ObjectBucketClaim) error {
+
+	switch v := configValue(params, obc, cfgObjectLock); v {
+	case "yes":
+		// object lock requires versioning, which it enables itself
+		if cfg.versioning == s3.BucketVersioningStatusSuspended {
+			return fmt.Errorf("%s requires %s %q", cfgObjectLock, cfgVersioning, s3.BucketVersioningStatusEnabled)
+		}
+		cfg.objectLock = true
+	case "", "no":
+	default:
+		return fmt.Errorf("invalid %s %q, must be \"yes\" or \"no\"", cfgObjectLock, v)
+	}
+
+	cfg.retentionMode = configValue(params, obc, cfgRetentionMode)
+	switch cfg.retentionMode {
+	case "":
+		return nil
+	case s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance:
+	default:
+		return fmt.Errorf("invalid %s %q, must be %q or %q", cfgRetentionMode, cfg.retentionMode,
+			s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance)
+	}
+	if !cfg.objectLock {
+		return fmt.Errorf("%s requires %s \"yes\"", cfgRetentionMode, cfgObjectLock)
+	}
+
+	// the default retention period is either in days or in years
+	days, years := configValue(params, obc, cfgRetentionDays), configValue(params, obc, cfgRetentionYears)
+	if (days == "") == (years == "") {
+		return fmt.Errorf("%s requires one of %s or %s", cfgRetentionMode, cfgRetentionDays, cfgRetentionYears)
+	}
+	key, v := cfgRetentionDays, days
+	if years != "" {
+		key, v = cfgRetentionYears, years
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid %s %q, must be a positive number", key, v)
+	}
+	cfg.retention = &s3.DefaultRetention{Mode: aws.String(cfg.retentionMode)}
+	if key == cfgRetentionDays {
+		cfg.retention.Days = aws.Int64(n)
+	} else {
+		cfg.retention.Years = aws.Int64(n)
+	}
+	return nil
+}
+
+// applyRetention sets the default retention of objects in the bucket.
+// Object lock must have been enabled when the bucket was created.
+func (p *awsS3Provisioner) applyRetention(bktName string, retention *s3.DefaultRetention) error {
+
+	glog.V(2).Infof("setting default retention of bucket %q to %s", bktName, retention)
+	_, err := p.s3svc.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+		Bucket: aws.String(bktName),
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule:              &s3.ObjectLockRule{DefaultRetention: retention},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error setting default retention of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
+
+// checkObjectLock returns an error if the bucket has object lock enabled
+// and still holds objects, as objects under retention can't be deleted.
+func (p *awsS3Provisioner) checkObjectLock(bktName string) error {
+
+	out, err := p.s3svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{Bucket: aws.String(bktName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errNoObjectLockConfig {
+			return nil
+		}
+		if isNoSuchBucketError(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting object lock configuration of bucket %q: %v", bktName, err)
+	}
+	if out.ObjectLockConfiguration == nil ||
+		aws.StringValue(out.ObjectLockConfiguration.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return nil
+	}
+
+	versions, err := p.s3svc.ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:  aws.String(bktName),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing objects in bucket %q: %v", bktName, err)
+	}
+	if len(versions.Versions) > 0 || len(versions.DeleteMarkers) > 0 {
+		return fmt.Errorf("bucket %q has object lock enabled and is not empty, "+
+			"its objects can't be deleted until their retention expires; "+
+			"delete them manually once it has and the bucket will then be deleted", bktName)
+	}
+	return nil
+}
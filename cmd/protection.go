@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// storage class parameters
+	scDeleteOnlyIfEmpty = "deleteOnlyIfEmpty"
+	scRetainData        = "retainData"
+	// OBC or OB annotation which, set to "true", prevents the bucket's
+	// deletion
+	annotationProtected = "cloudian-s3.io/deletion-protection"
+)
+
+// setDeletionOptions sets the receiver fields from the storage class's
+// deleteOnlyIfEmpty and retainData parameters.
+func (p *awsS3Provisioner) setDeletionOptions(params map[string]string) {
+	p.deleteOnlyIfEmpty = params[scDeleteOnlyIfEmpty] == "yes"
+	p.retainData = params[scRetainData] == "yes"
+}
+
+// deletionProtected returns true if the OB, or its claim, is annotated
+// with the deletion protection.
+func (p *awsS3Provisioner) deletionProtected(ob *v1alpha1.ObjectBucket) (bool, error) {
+
+	if ob.Annotations[annotationProtected] == "true" {
+		return true, nil
+	}
+	ref := ob.Spec.ClaimRef
+	if ref == nil || p.libClientset == nil {
+		return false, nil
+	}
+	obc, err := p.libClientset.ObjectbucketV1alpha1().ObjectBucketClaims(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error getting OBC \"%s/%s\": %v", ref.Namespace, ref.Name, err)
+	}
+	return obc.Annotations[annotationProtected] == "true", nil
+}
+
+// checkDeletionAllowed returns an error, after marking the OB Failed and
+// emitting an event, if the bucket is protected from deletion or isn't
+// empty when the storage class only deletes empty buckets. Emptiness is
+// checked before the grace period starts: the bucket pending deletion
+// denies listing it, and can't be written to anyway.
+func (p *awsS3Provisioner) checkDeletionAllowed(ob *v1alpha1.ObjectBucket) error {
+
+	protected, err := p.deletionProtected(ob)
+	if err != nil {
+		return err
+	}
+	if protected {
+		return p.refuseDeletion(ob, "DeletionProtected",
+			fmt.Sprintf("bucket %q is protected from deletion, remove the %s annotation from the claim and ObjectBucket to delete it",
+				p.bucketName, annotationProtected))
+	}
+
+	if _, pending := ob.Annotations[annotationDeleteAfter]; p.deleteOnlyIfEmpty && !pending {
+		empty, err := p.bucketEmpty(p.bucketName)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return p.refuseDeletion(ob, "BucketNotEmpty",
+				fmt.Sprintf("bucket %q is not empty and its storage class only deletes empty buckets", p.bucketName))
+		}
+	}
+	return nil
+}
+
+// refuseDeletion reports why the bucket can't be deleted and returns it as
+// an error, so the bucket library retries.
+func (p *awsS3Provisioner) refuseDeletion(ob *v1alpha1.ObjectBucket, reason, msg string) error {
+
+	glog.Errorf("not deleting bucket for OB %q: %s", ob.Name, msg)
+	p.eventf(ob, corev1.EventTypeWarning, reason, msg)
+	err := p.setOBPhase(ob.Name, v1alpha1.ObjectBucketStatusPhaseFailed)
+	if err != nil {
+		glog.Errorf("error marking OB %q %s: %v", ob.Name, v1alpha1.ObjectBucketStatusPhaseFailed, err)
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// setOBPhase sets the phase in the OB's status.
+func (p *awsS3Provisioner) setOBPhase(obName string, phase v1alpha1.ObjectBucketStatusPhase) error {
+
+	if p.libClientset == nil {
+		return nil
+	}
+	obs := p.libClientset.ObjectbucketV1alpha1().ObjectBuckets()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ob, err := obs.Get(obName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		ob.Status.Phase = phase
+		_, err = obs.UpdateStatus(ob)
+		return err
+	})
+}
+
+// bucketEmpty returns true if the bucket holds no objects, versions or
+// delete markers. A bucket which doesn't exist is empty.
+func (p *awsS3Provisioner) bucketEmpty(bktName string) (bool, error) {
+
+	out, err := p.s3svc.ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:  aws.String(bktName),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		if isNoSuchBucketError(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error listing objects in bucket %q: %v", bktName, err)
+	}
+	return len(out.Versions) == 0 && len(out.DeleteMarkers) == 0, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	// objects listed, and deleted, per page
+	purgePageSize = 1000
+	// objects per DeleteObjects request, so a page is deleted in parallel
+	purgeBatchSize = 250
+	// default number of concurrent delete and abort requests
+	defaultPurgeConcurrency = 4
+)
+
+// purgeProgress is the position and counts of a bucket purge.
+type purgeProgress struct {
+	// listing position of the next page of versions
+	KeyMarker       string `json:"keyMarker,omitempty"`
+	VersionIDMarker string `json:"versionIdMarker,omitempty"`
+	// objects versions and delete markers deleted, uploads aborted
+	Deleted int64 `json:"deleted"`
+	Aborted int64 `json:"aborted"`
+}
+
+// purgeBucket deletes all objects in the bucket and then the empty bucket.
+// A bucket that no longer exists is not an error.
+func (p *awsS3Provisioner) purgeBucket(bktName string) error {
+	return p.purgeBucketFrom(bktName, &purgeProgress{}, nil)
+}
+
+// purgeBucketFrom aborts the bucket's multipart uploads, deletes all its
+// object versions and delete markers, starting at the progress' position,
+// and then the empty bucket. checkpoint, if set, is called with the
+// progress after each page and once the listing pass is over.
+func (p *awsS3Provisioner) purgeBucketFrom(bktName string, progress *purgeProgress, checkpoint func(*purgeProgress) error) error {
+
+	// refuse to start deleting objects which may be locked
+	err := p.checkObjectLock(bktName)
+	if err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("Aborting multipart uploads in bucket %q", bktName)
+	err = p.abortMultipartUploads(bktName, progress)
+	if err != nil && !isNoSuchBucketError(err) {
+		return fmt.Errorf("Error aborting multipart uploads in bucket %q: %v", bktName, err)
+	}
+
+	glog.V(2).Infof("Deleting all objects in bucket %q", bktName)
+	err = p.deleteObjectVersions(bktName, progress, checkpoint)
+	// Whether the pass completed or failed, the next attempt lists the
+	// bucket from the start: objects whose deletion failed, or written
+	// behind the marker meanwhile, are only found that way.
+	progress.KeyMarker = ""
+	progress.VersionIDMarker = ""
+	if checkpoint != nil {
+		if cerr := checkpoint(progress); cerr != nil {
+			glog.Errorf("unable to checkpoint purge of bucket %q: %v", bktName, cerr)
+		}
+	}
+	if err != nil && !isNoSuchBucketError(err) {
+		return fmt.Errorf("Error deleting objects from bucket %q: %v", bktName, err)
+	}
+
+	glog.V(2).Infof("Deleting empty bucket %q", bktName)
+	_, err = p.s3svc.DeleteBucket(&s3.DeleteBucketInput{
+		Bucket: aws.String(bktName),
+	})
+	if err != nil && !isNoSuchBucketError(err) {
+		return fmt.Errorf("Error deleting empty bucket %q: %v", bktName, err)
+	}
+	glog.Infof("Purged bucket %q: deleted %d objects, aborted %d uploads", bktName, progress.Deleted, progress.Aborted)
+	return nil
+}
+
+// deleteObjectVersions deletes the object versions and delete markers of
+// the bucket a page at a time, each page in parallel batches.
+func (p *awsS3Provisioner) deleteObjectVersions(bktName string, progress *purgeProgress, checkpoint func(*purgeProgress) error) error {
+
+	input := &s3.ListObjectVersionsInput{
+		Bucket:  aws.String(bktName),
+		MaxKeys: aws.Int64(purgePageSize),
+	}
+	if progress.KeyMarker != "" {
+		input.KeyMarker = aws.String(progress.KeyMarker)
+		input.VersionIdMarker = aws.String(progress.VersionIDMarker)
+	}
+
+	for {
+		page, err := p.s3svc.ListObjectVersions(input)
+		if err != nil {
+			return err
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for _, v := range page.Versions {
+			objects = append(objects, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range page.DeleteMarkers {
+			objects = append(objects, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+
+		batches := [][]*s3.ObjectIdentifier{}
+		for len(objects) > 0 {
+			n := purgeBatchSize
+			if len(objects) < n {
+				n = len(objects)
+			}
+			batches = append(batches, objects[:n])
+			objects = objects[n:]
+		}
+		deleted, err := p.parallel(len(batches), func(i int) (int64, error) {
+			return p.deleteObjects(bktName, batches[i])
+		})
+		progress.Deleted += deleted
+		if err != nil {
+			return err
+		}
+
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.VersionIdMarker = page.NextVersionIdMarker
+		progress.KeyMarker = aws.StringValue(page.NextKeyMarker)
+		progress.VersionIDMarker = aws.StringValue(page.NextVersionIdMarker)
+		glog.Infof("Purging bucket %q: %d objects deleted so far", bktName, progress.Deleted)
+		if checkpoint != nil {
+			if err := checkpoint(progress); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deleteObjects deletes a batch of object versions, returning how many
+// were deleted.
+func (p *awsS3Provisioner) deleteObjects(bktName string, objects []*s3.ObjectIdentifier) (int64, error) {
+
+	out, err := p.s3svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(bktName),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(out.Errors) > 0 {
+		e := out.Errors[0]
+		return int64(len(objects) - len(out.Errors)), fmt.Errorf("failed to delete %d objects, first %q (version %q): %s: %s",
+			len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.VersionId), aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+	return int64(len(objects)), nil
+}
+
+// abortMultipartUploads aborts all the bucket's multipart uploads, in
+// parallel a page at a time.
+func (p *awsS3Provisioner) abortMultipartUploads(bktName string, progress *purgeProgress) error {
+
+	var abortErr error
+	err := p.s3svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket:     aws.String(bktName),
+		MaxUploads: aws.Int64(purgePageSize),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		uploads := page.Uploads
+		var aborted int64
+		aborted, abortErr = p.parallel(len(uploads), func(i int) (int64, error) {
+			_, err := p.s3svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bktName),
+				Key:      uploads[i].Key,
+				UploadId: uploads[i].UploadId,
+			})
+			if err != nil {
+				return 0, err
+			}
+			return 1, nil
+		})
+		progress.Aborted += aborted
+		return abortErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return abortErr
+}
+
+// parallel calls f for 0..n-1 with at most purgeConcurrency calls at a
+// time, returning the sum of their counts and the first error.
+func (p *awsS3Provisioner) parallel(n int, f func(i int) (int64, error)) (int64, error) {
+
+	concurrency := p.purgeConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultPurgeConcurrency
+	}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		total    int64
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			count, err := f(i)
+			mu.Lock()
+			defer mu.Unlock()
+			total += count
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(i)
+	}
+	wg.Wait()
+	return total, firstErr
+}
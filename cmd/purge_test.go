@@ -0,0 +1,152 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPurgeBucket(t *testing.T) {
+
+	withMarkers := []fakeObject{
+		{key: "a", version: "v1"},
+		{key: "b", version: "v1"},
+		{key: "b", version: "v2", marker: true},
+		{key: "c", version: "v1"},
+		{key: "d", version: "v1"},
+		{key: "e", version: "v1"},
+		{key: "f", version: "v1", marker: true},
+	}
+
+	tests := []struct {
+		name    string
+		s3      *fakeS3
+		wantErr bool
+		// counts once done, and the objects left
+		wantProgress purgeProgress
+		wantBucket   bool
+		wantObjects  int
+		notCalled    []string
+	}{
+		{"empty bucket", &fakeS3{}, false, purgeProgress{}, false, 0, nil},
+		{
+			"versions, delete markers and uploads over several pages",
+			&fakeS3{objects: withMarkers, uploads: []string{"x", "y"}, pageSize: 2},
+			false, purgeProgress{Deleted: 7, Aborted: 2}, false, 0, nil,
+		},
+		{"bucket already deleted", &fakeS3{noBucket: true}, false, purgeProgress{}, false, 0, nil},
+		{
+			"object lock with objects",
+			&fakeS3{objectLock: true, objects: fakeObjects("a", "b")},
+			true, purgeProgress{}, true, 2, []string{"DeleteObjects", "DeleteBucket"},
+		},
+		{"object lock without objects", &fakeS3{objectLock: true}, false, purgeProgress{}, false, 0, nil},
+		{
+			"objects failing to delete",
+			&fakeS3{objects: fakeObjects("a", "b", "c"), failKeys: map[string]bool{"b": true}},
+			true, purgeProgress{Deleted: 2}, true, 1, []string{"DeleteBucket"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsS3Provisioner{s3svc: tt.s3}
+			progress := &purgeProgress{}
+			err := p.purgeBucketFrom("bkt", progress, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("purgeBucketFrom() error = %v, want error %v", err, tt.wantErr)
+			}
+			if *progress != tt.wantProgress {
+				t.Errorf("progress = %+v, want %+v", *progress, tt.wantProgress)
+			}
+			if !tt.s3.noBucket != tt.wantBucket {
+				t.Errorf("bucket exists = %v, want %v", !tt.s3.noBucket, tt.wantBucket)
+			}
+			if len(tt.s3.objects) != tt.wantObjects {
+				t.Errorf("objects left %v, want %d", tt.s3.objects, tt.wantObjects)
+			}
+			for _, call := range tt.s3.calls {
+				for _, not := range tt.notCalled {
+					if strings.HasPrefix(call, not+" ") {
+						t.Errorf("unexpected call %q", call)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeBucketFromCheckpoints(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		objects  []fakeObject
+		progress purgeProgress
+		wantErr  bool
+		// listings in order, by their key marker
+		wantLists       []string
+		wantCheckpoints []purgeProgress
+	}{
+		{
+			"checkpoint after each page",
+			fakeObjects("a", "b", "c", "d", "e"), purgeProgress{}, false,
+			[]string{"", "b", "d"},
+			[]purgeProgress{
+				{KeyMarker: "b", VersionIDMarker: "v1", Deleted: 2},
+				{KeyMarker: "d", VersionIDMarker: "v1", Deleted: 4},
+				{Deleted: 5},
+			},
+		},
+		{
+			// objects before the marker, such as written during an
+			// earlier pass, keep the bucket from being deleted, the
+			// next attempt lists the bucket from the start
+			"resumed from the marker",
+			fakeObjects("a", "c", "d"), purgeProgress{KeyMarker: "b", VersionIDMarker: "v1", Deleted: 2}, true,
+			[]string{"b"},
+			[]purgeProgress{{Deleted: 4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3{objects: tt.objects, pageSize: 2}
+			p := &awsS3Provisioner{s3svc: f}
+			checkpoints := []purgeProgress{}
+			progress := tt.progress
+			err := p.purgeBucketFrom("bkt", &progress, func(pp *purgeProgress) error {
+				checkpoints = append(checkpoints, *pp)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("purgeBucketFrom() error = %v, want error %v", err, tt.wantErr)
+			}
+			lists := []string{}
+			for _, call := range f.calls {
+				if strings.HasPrefix(call, "ListObjectVersions ") {
+					lists = append(lists, strings.TrimPrefix(call, "ListObjectVersions "))
+				}
+			}
+			if !reflect.DeepEqual(lists, tt.wantLists) {
+				t.Errorf("listed from %q, want %q", lists, tt.wantLists)
+			}
+			if !reflect.DeepEqual(checkpoints, tt.wantCheckpoints) {
+				t.Errorf("checkpoints %+v, want %+v", checkpoints, tt.wantCheckpoints)
+			}
+		})
+	}
+}
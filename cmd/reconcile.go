@@ -0,0 +1,391 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned"
+	informers "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/informers/externalversions"
+	listers "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/listers/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	storageV1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// OB annotations recording the claim generation and storage class
+	// version last applied to the bucket
+	annotationAppliedGeneration   = "cloudian-s3.io/applied-generation"
+	annotationAppliedStorageClass = "cloudian-s3.io/applied-storage-class-version"
+)
+
+// bucketReconciler keeps bound claims' buckets and IAM policies in line with
+// their storage class and additionalConfig. The bucket library only calls
+// Provision once, so nothing else revisits a bucket after it's created.
+// Claims are reconciled when they, their OB or their storage class change,
+// and every resync period to catch changes made on the backend.
+type bucketReconciler struct {
+	// prov is copied for each reconcile to create its sessions
+	prov         awsS3Provisioner
+	libClientset versioned.Interface
+	obcLister    listers.ObjectBucketClaimLister
+	obLister     listers.ObjectBucketLister
+	scLister     storagelisters.StorageClassLister
+	synced       []cache.InformerSynced
+	queue        workqueue.RateLimitingInterface
+}
+
+func newBucketReconciler(prov awsS3Provisioner, libClientset versioned.Interface, factory informers.SharedInformerFactory, kubeFactory kubeinformers.SharedInformerFactory) *bucketReconciler {
+
+	obcInformer := factory.Objectbucket().V1alpha1().ObjectBucketClaims()
+	obInformer := factory.Objectbucket().V1alpha1().ObjectBuckets()
+	scInformer := kubeFactory.Storage().V1().StorageClasses()
+	r := &bucketReconciler{
+		prov:         prov,
+		libClientset: libClientset,
+		obcLister:    obcInformer.Lister(),
+		obLister:     obInformer.Lister(),
+		scLister:     scInformer.Lister(),
+		synced: []cache.InformerSynced{
+			obcInformer.Informer().HasSynced,
+			obInformer.Informer().HasSynced,
+			scInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	obcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldObc := old.(*v1alpha1.ObjectBucketClaim)
+			newObc := new.(*v1alpha1.ObjectBucketClaim)
+			// reconcile newly bound claims, to add our settings to the
+			// ConfigMap created by the bucket library, and claims whose
+			// configuration or labels changed
+			bound := newObc.Status.Phase == v1alpha1.ObjectBucketClaimStatusPhaseBound &&
+				oldObc.Status.Phase != v1alpha1.ObjectBucketClaimStatusPhaseBound
+			if !bound && reflect.DeepEqual(oldObc.Spec.AdditionalConfig, newObc.Spec.AdditionalConfig) &&
+				reflect.DeepEqual(oldObc.Labels, newObc.Labels) {
+				return
+			}
+			r.enqueue(new)
+		},
+	})
+
+	obInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldOb := old.(*v1alpha1.ObjectBucket)
+			newOb := new.(*v1alpha1.ObjectBucket)
+			// periodic resyncs, which leave the resource version as it
+			// is, revisit the backend; edits of the OB's spec are undone
+			if oldOb.ResourceVersion != newOb.ResourceVersion && oldOb.Generation == newOb.Generation {
+				return
+			}
+			if ref := newOb.Spec.ClaimRef; ref != nil {
+				r.queue.AddRateLimited(ref.Namespace + "/" + ref.Name)
+			}
+		},
+	})
+
+	// storage class parameters are immutable, a changed class is deleted
+	// and created again
+	scInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			r.enqueueClaimsOf(obj.(*storageV1.StorageClass))
+		},
+		UpdateFunc: func(old, new interface{}) {
+			if old.(*storageV1.StorageClass).ResourceVersion != new.(*storageV1.StorageClass).ResourceVersion {
+				r.enqueueClaimsOf(new.(*storageV1.StorageClass))
+			}
+		},
+	})
+	return r
+}
+
+func (r *bucketReconciler) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	r.queue.AddRateLimited(key)
+}
+
+// enqueueClaimsOf queues the claims of one of our storage classes.
+func (r *bucketReconciler) enqueueClaimsOf(sc *storageV1.StorageClass) {
+
+	if sc.Provisioner != provisionerName {
+		return
+	}
+	obcs, err := r.obcLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, obc := range obcs {
+		if obc.Spec.StorageClassName == sc.Name {
+			r.enqueue(obc)
+		}
+	}
+}
+
+// Run processes queued claims until stopCh is closed.
+func (r *bucketReconciler) Run(stopCh <-chan struct{}) {
+	defer r.queue.ShutDown()
+
+	if !cache.WaitForCacheSync(stopCh, r.synced...) {
+		glog.Errorf("reconciler: failed to wait for caches to sync")
+		return
+	}
+	go wait.Until(r.runWorker, time.Second, stopCh)
+	<-stopCh
+}
+
+func (r *bucketReconciler) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *bucketReconciler) processNextItem() bool {
+	obj, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(obj)
+
+	key := obj.(string)
+	if err := r.reconcile(key); err != nil {
+		glog.Errorf("reconciler: error reconciling OBC %q, requeuing: %v", key, err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(obj)
+	return true
+}
+
+// reconcile computes the desired configuration of the bucket and IAM policy
+// of the claim with key, and applies whatever differs on the backend.
+func (r *bucketReconciler) reconcile(key string) error {
+
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	obc, err := r.obcLister.ObjectBucketClaims(ns).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// only bound claims which aren't being deleted have a bucket to reconcile
+	if obc.DeletionTimestamp != nil || obc.Spec.ObjectBucketName == "" ||
+		obc.Status.Phase != v1alpha1.ObjectBucketClaimStatusPhaseBound {
+		return nil
+	}
+
+	p := r.prov
+	sc, err := r.scLister.Get(obc.Spec.StorageClassName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sc.Provisioner != provisionerName {
+		return nil
+	}
+
+	ob, err := r.obLister.Get(obc.Spec.ObjectBucketName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ob.DeletionTimestamp != nil || ob.Status.Phase == v1alpha1.ObjectBucketStatusPhaseReleased {
+		return nil
+	}
+
+	// retrying won't fix an invalid configuration, wait for the next change
+	cfg, err := getBucketConfig(sc.Parameters, obc)
+	if err != nil {
+		glog.Errorf("reconciler: invalid bucket configuration for OBC %q: %v", key, err)
+		return nil
+	}
+	// existing (brownfield) buckets are only configured if the storage
+	// class allows it
+	existing := sc.Parameters[v1alpha1.StorageClassBucket] != ""
+	if existing {
+		cfg = cfg.existingBucketConfig()
+		if !modifyExisting(sc.Parameters) {
+			cfg = &bucketConfig{}
+		}
+	} else {
+		// settings removed from the claim or storage class are removed
+		// from the buckets the operator created
+		cfg.exclusive = true
+	}
+
+	err = p.setFromObState(ob)
+	if err != nil {
+		return err
+	}
+	options := &apibkt.BucketOptions{
+		BucketName:        p.bucketName,
+		ObjectBucketClaim: obc,
+		Parameters:        sc.Parameters,
+	}
+
+	// the claim is provisioned, clean up what failed attempts left in its
+	// journal
+	err = p.settleJournal(obc, ob)
+	if err != nil {
+		return err
+	}
+
+	// check what was provisioned for the claim still exists, and repair
+	// it if the storage class allows
+	drift, err := p.detectDrift()
+	if err != nil {
+		return err
+	}
+	var repairErr error
+	if sc.Parameters[scRepairDrift] == "yes" {
+		repairErr = r.repairDrift(&p, drift, ob, options)
+	}
+	err = r.recordDrift(&p, ob, drift.findings(&p))
+	if err != nil {
+		return err
+	}
+	if repairErr != nil {
+		return repairErr
+	}
+	if drift.bucketMissing {
+		return nil
+	}
+
+	diff, err := p.bucketConfigDiff(p.bucketName, cfg)
+	if err != nil {
+		return err
+	}
+	if diff != nil {
+		glog.Infof("reconciler: applying configuration of OBC %q to bucket %q", key, p.bucketName)
+		err = p.applyBucketConfig(p.bucketName, diff)
+		if err != nil {
+			return err
+		}
+	}
+
+	// existing buckets are shared by claims, only new ones have their tags
+	if !existing {
+		err = p.updateBucketTags(p.bucketName, labelTags(sc.Parameters[scTagLabelPrefix], sc.Labels, obc.Labels))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !drift.userMissing && !drift.policyMissing {
+		_, err = p.reconcileUserPolicy(p.bucketName, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !existing || modifyExisting(sc.Parameters) {
+		err = r.syncConfigData(obc, ob, cfg.configData())
+		if err != nil {
+			return err
+		}
+	}
+	return r.recordApplied(ob, obc, sc)
+}
+
+// recordApplied records in the OB the generation of the claim and the
+// version of the storage class last applied to the bucket.
+func (r *bucketReconciler) recordApplied(ob *v1alpha1.ObjectBucket, obc *v1alpha1.ObjectBucketClaim, sc *storageV1.StorageClass) error {
+
+	applied := map[string]string{
+		annotationAppliedGeneration:   strconv.FormatInt(obc.Generation, 10),
+		annotationAppliedStorageClass: sc.ResourceVersion,
+	}
+	for k, v := range applied {
+		if ob.Annotations[k] != v {
+			return setOBAnnotations(r.libClientset, ob.Name, applied)
+		}
+	}
+	return nil
+}
+
+// syncConfigData records the bucket's settings in the OB and adds them to
+// the OBC's ConfigMap.
+func (r *bucketReconciler) syncConfigData(obc *v1alpha1.ObjectBucketClaim, ob *v1alpha1.ObjectBucket, data map[string]string) error {
+
+	old := ob.Spec.Endpoint.AdditionalConfigData
+	if !reflect.DeepEqual(old, data) {
+		ob = ob.DeepCopy()
+		ob.Spec.Endpoint.AdditionalConfigData = data
+		_, err := r.libClientset.ObjectbucketV1alpha1().ObjectBuckets().Update(ob)
+		if err != nil {
+			return fmt.Errorf("error updating OB %q: %v", ob.Name, err)
+		}
+	}
+
+	// the ConfigMap is named after the claim
+	cms := r.prov.clientset.CoreV1().ConfigMaps(obc.Namespace)
+	cm, err := cms.Get(obc.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting ConfigMap of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	changed := false
+	for k := range old {
+		if _, ok := data[k]; !ok && cm.Data[k] != "" {
+			delete(cm.Data, k)
+			changed = true
+		}
+	}
+	for k, v := range data {
+		if cm.Data[k] != v {
+			if cm.Data == nil {
+				cm.Data = map[string]string{}
+			}
+			cm.Data[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = cms.Update(cm)
+	if err != nil {
+		return fmt.Errorf("error updating ConfigMap of OBC \"%s/%s\": %v", obc.Namespace, obc.Name, err)
+	}
+	return nil
+}
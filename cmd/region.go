@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+const (
+	// storage class parameters
+	scRegion             = "region"
+	scLocationConstraint = "locationConstraint"
+	// region of buckets created without a location constraint
+	s3DefaultLocation = "us-east-1"
+)
+
+// bucketLocation returns the location constraint of buckets created with
+// the storage class parameters, which defaults to the region.
+func bucketLocation(params map[string]string, region string) string {
+
+	if loc := params[scLocationConstraint]; loc != "" {
+		return loc
+	}
+	return region
+}
+
+// createBucketConfiguration returns the configuration creating a bucket in
+// the location, or nil for the default location.
+func createBucketConfiguration(loc string) *s3.CreateBucketConfiguration {
+
+	if loc == "" || loc == s3DefaultLocation {
+		return nil
+	}
+	return &s3.CreateBucketConfiguration{LocationConstraint: aws.String(loc)}
+}
+
+// checkBucketLocation verifies that an existing bucket is in the location
+// configured in the storage class parameters. If the storage class has no
+// region the bucket's region is discovered, and the s3 service switched to
+// it.
+func (p *awsS3Provisioner) checkBucketLocation(bktName string, params map[string]string) error {
+
+	out, err := p.s3svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bktName)})
+	if err != nil {
+		return fmt.Errorf("error getting location of bucket %q: %v", bktName, err)
+	}
+	loc := s3.NormalizeBucketLocation(aws.StringValue(out.LocationConstraint))
+
+	want := bucketLocation(params, params[scRegion])
+	if want != "" {
+		if s3.NormalizeBucketLocation(want) != loc {
+			return fmt.Errorf("bucket %q is in location %q, not %q as set in the storage class", bktName, loc, want)
+		}
+		return nil
+	}
+
+	if loc != p.region {
+		glog.Infof("bucket %q is in region %q, using it instead of %q", bktName, loc, p.region)
+		p.region = loc
+		p.s3Session = p.s3Session.Copy(&aws.Config{Region: aws.String(loc)})
+		p.s3svc = s3.New(p.s3Session)
+	}
+	return nil
+}
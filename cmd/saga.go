@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// sagaStep is a completed step of a saga and the action undoing it.
+type sagaStep struct {
+	name string
+	undo func() error
+}
+
+// saga runs the steps of provisioning and, when one fails, undoes those
+// completed so far in reverse order.
+type saga struct {
+	name string
+	done []sagaStep
+}
+
+func newSaga(name string) *saga {
+	return &saga{name: name}
+}
+
+// run runs a step. Once it succeeds, undo, if not nil, is the compensation
+// run should a later step fail.
+func (s *saga) run(name string, do, undo func() error) error {
+
+	glog.V(2).Infof("%s: %s", s.name, name)
+	err := do()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if undo != nil {
+		s.done = append(s.done, sagaStep{name: name, undo: undo})
+	}
+	return nil
+}
+
+// compensate undoes the completed steps, latest first, after err failed
+// the saga. The returned error reports err along with the compensations
+// which failed, and so left something behind.
+func (s *saga) compensate(err error) error {
+
+	glog.Errorf("%s failed, undoing %d steps: %v", s.name, len(s.done), err)
+	sErr := &sagaError{name: s.name, err: err}
+	for i := len(s.done) - 1; i >= 0; i-- {
+		step := s.done[i]
+		if uerr := step.undo(); uerr != nil {
+			glog.Errorf("%s: failed to undo %s: %v", s.name, step.name, uerr)
+			sErr.failed = append(sErr.failed, fmt.Sprintf("%s (%v)", step.name, uerr))
+			continue
+		}
+		glog.V(2).Infof("%s: undid %s", s.name, step.name)
+	}
+	s.done = nil
+	return sErr
+}
+
+// sagaError is the failure of a saga, listing the compensations which
+// failed.
+type sagaError struct {
+	name   string
+	err    error
+	failed []string
+}
+
+func (e *sagaError) Error() string {
+	if len(e.failed) == 0 {
+		return fmt.Sprintf("%s failed and was undone: %v", e.name, e.err)
+	}
+	return fmt.Sprintf("%s failed: %v; manual clean up required, failed to undo: %s",
+		e.name, e.err, strings.Join(e.failed, "; "))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSagaCompensate(t *testing.T) {
+
+	type step struct {
+		name     string
+		failDo   bool
+		noUndo   bool
+		failUndo bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// undos run, in order
+		wantUndone []string
+		wantErr    string
+	}{
+		{
+			name:       "latest first",
+			steps:      []step{{name: "a"}, {name: "b"}, {name: "c"}, {name: "d", failDo: true}},
+			wantUndone: []string{"c", "b", "a"},
+			wantErr:    "provision failed and was undone: d: failed",
+		},
+		{
+			name:       "failing step isn't undone",
+			steps:      []step{{name: "a"}, {name: "b", failDo: true}},
+			wantUndone: []string{"a"},
+			wantErr:    "provision failed and was undone: b: failed",
+		},
+		{
+			name:       "steps without undo skipped",
+			steps:      []step{{name: "a"}, {name: "b", noUndo: true}, {name: "c"}, {name: "d", failDo: true}},
+			wantUndone: []string{"c", "a"},
+			wantErr:    "provision failed and was undone: d: failed",
+		},
+		{
+			name:       "failed undos listed and the rest still undone",
+			steps:      []step{{name: "a", failUndo: true}, {name: "b"}, {name: "c", failUndo: true}, {name: "d", failDo: true}},
+			wantUndone: []string{"c", "b", "a"},
+			wantErr:    "provision failed: d: failed; manual clean up required, failed to undo: c (stuck); a (stuck)",
+		},
+		{
+			name:    "first step failing",
+			steps:   []step{{name: "a", failDo: true}},
+			wantErr: "provision failed and was undone: a: failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSaga("provision")
+			var undone []string
+			var err error
+			for _, st := range tt.steps {
+				st := st
+				var undo func() error
+				if !st.noUndo {
+					undo = func() error {
+						undone = append(undone, st.name)
+						if st.failUndo {
+							return errors.New("stuck")
+						}
+						return nil
+					}
+				}
+				err = s.run(st.name, func() error {
+					if st.failDo {
+						return errors.New("failed")
+					}
+					return nil
+				}, undo)
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Fatal("no step failed")
+			}
+			err = s.compensate(err)
+			if !reflect.DeepEqual(undone, tt.wantUndone) {
+				t.Errorf("undone %q, want %q", undone, tt.wantUndone)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("compensate() = %q, want %q", err, tt.wantErr)
+			}
+			// compensations run once
+			undone = nil
+			s.compensate(err)
+			if len(undone) != 0 {
+				t.Errorf("compensating again undid %q", undone)
+			}
+		})
+	}
+}
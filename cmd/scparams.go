@@ -0,0 +1,172 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	storageV1 "k8s.io/api/storage/v1"
+)
+
+// paramValidator checks the value of a storage class parameter, nil
+// accepts any value.
+type paramValidator func(key, value string) error
+
+// bucketConfigKeys are the storage class parameters configuring buckets,
+// the only ones an OBC's additionalConfig may override. They are validated
+// together by getBucketConfig.
+var bucketConfigKeys = []string{
+	cfgVersioning,
+	cfgLifecycle,
+	cfgExpireAfterDays,
+	cfgNoncurrentExpireAfterDays,
+	cfgAbortMultipartDays,
+	cfgEncryption,
+	cfgKMSKeyID,
+	cfgDenyUnencrypted,
+	cfgObjectLock,
+	cfgRetentionMode,
+	cfgRetentionDays,
+	cfgRetentionYears,
+	cfgCors,
+	cfgCorsAllowedOrigins,
+	cfgAdoptExisting,
+}
+
+// scParams is the schema of the storage class parameters understood by the
+// operator.
+var scParams = map[string]paramValidator{
+	scRegion:                         nil,
+	scLocationConstraint:             nil,
+	"secretName":                     nil,
+	"secretNamespace":                nil,
+	"s3Endpoint":                     validateAPIURL,
+	"iamEndpoint":                    validateAPIURL,
+	v1alpha1.StorageClassBucket:      nil,
+	"createBucketUser":               validateYesNo,
+	"bucketClaimUserSecretName":      nil,
+	"bucketClaimUserSecretNamespace": nil,
+	"bucketPolicyAccess":             validateYesNo,
+	"iamPolicy":                      validateIAMPolicy,
+	"userNameTemplate":               validateUserNameTemplate,
+	scStoragePolicyID:                nil,
+	scStoragePolicyName:              nil,
+	scAdminEndpoint:                  validateAPIURL,
+	scAdminSecretName:                nil,
+	scAdminSecretNamespace:           nil,
+	scAdminInsecure:                  validateYesNo,
+	scClaimOverrides:                 validateClaimOverrides,
+	scModifyExisting:                 validateYesNo,
+	scTagLabelPrefix:                 nil,
+	scAllowedNamespaces:              nil,
+	scDeleteGracePeriod:              validateDeleteGracePeriod,
+	scDeleteOnlyIfEmpty:              validateYesNo,
+	scRetainData:                     validateYesNo,
+	scRepairDrift:                    validateYesNo,
+}
+
+func init() {
+	for _, key := range bucketConfigKeys {
+		scParams[key] = nil
+	}
+}
+
+// validateStorageClassParams checks the parameters of a storage class of
+// this provisioner against the schema, returning all the problems found.
+func validateStorageClassParams(sc *storageV1.StorageClass) error {
+
+	errs := []string{}
+	keys := make([]string, 0, len(sc.Parameters))
+	for key := range sc.Parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		validate, ok := scParams[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("unknown parameter %q", key))
+			continue
+		}
+		if validate != nil {
+			if err := validate(key, sc.Parameters[key]); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if _, err := getBucketConfig(sc.Parameters, nil); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sc.Parameters[scStoragePolicyID] != "" && sc.Parameters[scStoragePolicyName] != "" {
+		errs = append(errs, fmt.Sprintf("only one of %s and %s may be set", scStoragePolicyID, scStoragePolicyName))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid parameters: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func validateYesNo(key, value string) error {
+	if value != "yes" && value != "no" {
+		return fmt.Errorf("invalid %s %q, must be \"yes\" or \"no\"", key, value)
+	}
+	return nil
+}
+
+func validateAPIURL(key, value string) error {
+	_, err := getApiURL(&storageV1.StorageClass{Parameters: map[string]string{key: value}}, key)
+	return err
+}
+
+func validateIAMPolicy(key, value string) error {
+	policy := PolicyDocument{}
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if len(policy.Statement) == 0 {
+		return fmt.Errorf("invalid %s: no statements", key)
+	}
+	return nil
+}
+
+func validateUserNameTemplate(key, value string) error {
+	_, err := getUserNameTemplate(map[string]string{key: value})
+	return err
+}
+
+func validateClaimOverrides(key, value string) error {
+	allowed := map[string]bool{}
+	for _, k := range bucketConfigKeys {
+		allowed[k] = true
+	}
+	for k := range claimOverrides(map[string]string{key: value}) {
+		if !allowed[k] {
+			return fmt.Errorf("invalid %s, %q can't be overridden by claims", key, k)
+		}
+	}
+	return nil
+}
+
+func validateDeleteGracePeriod(key, value string) error {
+	_, err := getDeleteGracePeriod(map[string]string{key: value})
+	return err
+}
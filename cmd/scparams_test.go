@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	storageV1 "k8s.io/api/storage/v1"
+)
+
+func TestValidateStorageClassParams(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		// substrings of the error, none if valid
+		wantErr []string
+	}{
+		{"no parameters", nil, nil},
+		{"valid", map[string]string{
+			scRegion:            "region1",
+			"s3Endpoint":        "s3.example.com",
+			"createBucketUser":  "no",
+			"userNameTemplate":  `{{printf "%.20s" .Namespace}}-{{.Rand}}`,
+			"iamPolicy":         `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:*"],"Resource":["*"]}]}`,
+			scClaimOverrides:    cfgVersioning + "," + cfgExpireAfterDays,
+			scDeleteGracePeriod: "72h",
+			cfgVersioning:       "Enabled",
+			cfgExpireAfterDays:  "30",
+		}, nil},
+		{"unknown parameter", map[string]string{"versioned": "yes"}, []string{`unknown parameter "versioned"`}},
+		{"all problems reported", map[string]string{
+			"createBucketUser": "true",
+			scRetainData:       "maybe",
+		}, []string{"createBucketUser", scRetainData}},
+		{"endpoint with a path", map[string]string{"s3Endpoint": "https://s3.example.com/s3"}, []string{"Invalid API endpoint"}},
+		{"policy not JSON", map[string]string{"iamPolicy": "allow all"}, []string{"invalid iamPolicy"}},
+		{"policy without statements", map[string]string{"iamPolicy": `{"Version":"2012-10-17"}`}, []string{"no statements"}},
+		{"template without Rand", map[string]string{"userNameTemplate": `{{printf "%.20s" .Namespace}}-{{printf "%.20s" .Claim}}`}, []string{"{{.Rand}}"}},
+		{"template too long", map[string]string{"userNameTemplate": "{{.Claim}}-{{.Rand}}"}, []string{"over the limit"}},
+		{"template not parsing", map[string]string{"userNameTemplate": "{{.Rand"}, []string{"userNameTemplate"}},
+		{"override of a non bucket setting", map[string]string{scClaimOverrides: "iamPolicy"}, []string{`"iamPolicy" can't be overridden`}},
+		{"negative grace period", map[string]string{scDeleteGracePeriod: "-1h"}, []string{scDeleteGracePeriod}},
+		{"grace period without unit", map[string]string{scDeleteGracePeriod: "3"}, []string{scDeleteGracePeriod}},
+		{"bad bucket config", map[string]string{cfgVersioning: "on"}, []string{cfgVersioning}},
+		{"both storage policy id and name", map[string]string{
+			scStoragePolicyID:   "id",
+			scStoragePolicyName: "name",
+		}, []string{"only one of"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStorageClassParams(&storageV1.StorageClass{Parameters: tt.params})
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("validateStorageClassParams() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateStorageClassParams() error = nil, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateStorageClassParams() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// storage class parameter delaying the purge of deleted claims' buckets
+	scDeleteGracePeriod = "deleteGracePeriod"
+	// OB annotation holding the time after which the bucket is purged
+	annotationDeleteAfter = "cloudian-s3.io/delete-after"
+	// OB annotation which, set to "true" during the grace period, keeps
+	// the bucket instead of purging it
+	annotationUndelete = "cloudian-s3.io/undelete"
+	// bucket tag holding the time after which the bucket is purged
+	tagPendingDeletion = tagPrefix + "pending-deletion"
+	// bucket tag marking buckets deliberately left behind by their claim
+	tagRetained = tagPrefix + "retained"
+	// Sid of the bucket policy statement denying access during the grace period
+	denyAllSid = bucketPolicySidPrefix + "DenyAllPendingDeletion"
+)
+
+// actions still allowed on a bucket pending deletion, so the operator can
+// lift the deny statement and change its tags
+var pendingDeletionAllowedActions = []string{
+	"s3:GetBucketPolicy",
+	"s3:PutBucketPolicy",
+	"s3:DeleteBucketPolicy",
+	"s3:GetBucketTagging",
+	"s3:PutBucketTagging",
+}
+
+// getDeleteGracePeriod returns the grace period set in the storage class,
+// 0 if none.
+func getDeleteGracePeriod(params map[string]string) (time.Duration, error) {
+
+	v, ok := params[scDeleteGracePeriod]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a duration such as \"72h\"", scDeleteGracePeriod, v)
+	}
+	return d, nil
+}
+
+// softDelete handles the grace period of the OB's bucket. On the first call
+// it denies all access to the bucket, tags it and records when it may be
+// purged, and until then returns an error so the bucket library retries.
+// It returns retain true if the bucket was undeleted and must be kept, and
+// false once the bucket may be purged.
+func (p *awsS3Provisioner) softDelete(ob *v1alpha1.ObjectBucket) (retain bool, err error) {
+
+	if p.deleteGracePeriod == 0 || (p.deleter != nil && p.deleter.started(ob)) {
+		return false, nil
+	}
+
+	if ob.Annotations[annotationUndelete] == "true" {
+		err = p.liftPendingDeletion(p.bucketName)
+		if err != nil {
+			return false, err
+		}
+		err = p.retainBucket(p.bucketName)
+		if err != nil {
+			return false, err
+		}
+		p.eventf(ob, corev1.EventTypeNormal, "BucketUndeleted",
+			"bucket %q was undeleted and is kept, its claim's credentials were revoked", p.bucketName)
+		return true, nil
+	}
+
+	v, ok := ob.Annotations[annotationDeleteAfter]
+	if !ok {
+		deadline := time.Now().Add(p.deleteGracePeriod).UTC().Format(time.RFC3339)
+		err = p.markPendingDeletion(p.bucketName, deadline)
+		if err != nil {
+			return false, err
+		}
+		err = setOBAnnotation(p.libClientset, ob.Name, annotationDeleteAfter, deadline)
+		if err != nil {
+			return false, err
+		}
+		p.eventf(ob, corev1.EventTypeNormal, "BucketPendingDeletion",
+			"bucket %q will be purged after %s, annotate the ObjectBucket with %s=true to keep it",
+			p.bucketName, deadline, annotationUndelete)
+		return false, fmt.Errorf("bucket %q is pending deletion until %s", p.bucketName, deadline)
+	}
+
+	deadline, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation %q of OB %q: %v", annotationDeleteAfter, v, ob.Name, err)
+	}
+	if time.Now().Before(deadline) {
+		return false, fmt.Errorf("bucket %q is pending deletion until %s", p.bucketName, v)
+	}
+
+	// the grace period is over, let the operator purge the bucket
+	glog.Infof("grace period of bucket %q expired at %s", p.bucketName, v)
+	return false, p.liftPendingDeletion(p.bucketName)
+}
+
+// markPendingDeletion tags the bucket with the deadline and denies all
+// access to it.
+func (p *awsS3Provisioner) markPendingDeletion(bktName, deadline string) error {
+
+	glog.Infof("denying access to bucket %q pending deletion until %s", bktName, deadline)
+	tags, err := p.getBucketTags(bktName)
+	if err != nil {
+		return fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+	tags[tagPendingDeletion] = deadline
+	err = p.tagBucket(bktName, tags)
+	if err != nil {
+		return err
+	}
+
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		return err
+	}
+	policy.removeStatements(denyAllSid)
+	raw, err := json.Marshal(&bucketPolicyStatement{
+		Sid:       denyAllSid,
+		Effect:    "Deny",
+		Principal: "*",
+		NotAction: pendingDeletionAllowedActions,
+		Resource:  []string{fmt.Sprintf(s3BucketArn, bktName), fmt.Sprintf(s3BucketArn, bktName) + "/*"},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling bucket policy statement, %s", err.Error())
+	}
+	if policy.Version == "" {
+		policy.Version = "2012-10-17"
+	}
+	policy.Statement = append(policy.Statement, raw)
+	err = p.putBucketPolicy(bktName, policy)
+	if err != nil {
+		return fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+	}
+	return nil
+}
+
+// liftPendingDeletion removes the deny statement and the pending deletion
+// tag from the bucket.
+func (p *awsS3Provisioner) liftPendingDeletion(bktName string) error {
+
+	policy, err := p.getBucketPolicy(bktName)
+	if err != nil {
+		return err
+	}
+	if policy.removeStatements(denyAllSid) > 0 {
+		err = p.putBucketPolicy(bktName, policy)
+		if err != nil {
+			return fmt.Errorf("error setting policy of bucket %q: %v", bktName, err)
+		}
+	}
+
+	tags, err := p.getBucketTags(bktName)
+	if err != nil {
+		return fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+	if _, ok := tags[tagPendingDeletion]; ok {
+		delete(tags, tagPendingDeletion)
+		return p.tagBucket(bktName, tags)
+	}
+	return nil
+}
+
+// retainBucket tags a bucket left behind by its claim, so the garbage
+// collector doesn't take it for an orphan.
+func (p *awsS3Provisioner) retainBucket(bktName string) error {
+
+	tags, err := p.getBucketTags(bktName)
+	if err != nil {
+		return fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+	tags[tagRetained] = time.Now().UTC().Format(time.RFC3339)
+	return p.tagBucket(bktName, tags)
+}
+
+// retainClaimBucket tags the bucket as retained if it was provisioned for
+// the OB's claim. Buckets of other claims, and brownfield buckets, are left
+// as they are.
+func (p *awsS3Provisioner) retainClaimBucket(ob *v1alpha1.ObjectBucket) error {
+
+	tags, err := p.getBucketTags(p.bucketName)
+	if err != nil {
+		if isNoSuchBucketError(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting tags of bucket %q: %v", p.bucketName, err)
+	}
+	if _, ok := tags[tagRetained]; ok || !p.ownedByCluster(tags) || !provisionedForClaim(tags, ob.Spec.ClaimRef) {
+		return nil
+	}
+	glog.Infof("Keeping bucket %q of OB %q, its claim's reclaim policy is Retain", p.bucketName, ob.Name)
+	return p.retainBucket(p.bucketName)
+}
+
+// eventf emits an event on the OB, if events are recorded.
+func (p *awsS3Provisioner) eventf(ob *v1alpha1.ObjectBucket, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.recorder != nil {
+		p.recorder.Eventf(ob, eventType, reason, messageFmt, args...)
+	}
+}
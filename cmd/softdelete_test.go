@@ -0,0 +1,209 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	libfake "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSoftDelete(t *testing.T) {
+
+	const (
+		period = 72 * time.Hour
+		other  = `{"Sid":"other","Effect":"Allow","Principal":"*","Action":"s3:GetObject","Resource":"arn:aws:s3:::bkt/*"}`
+		deny   = `{"Sid":"` + denyAllSid + `","Effect":"Deny","Principal":"*","NotAction":["s3:GetBucketPolicy"],"Resource":["arn:aws:s3:::bkt"]}`
+	)
+	policy := func(stmts ...string) *string {
+		return aws.String(`{"Version":"2012-10-17","Statement":[` + strings.Join(stmts, ",") + `]}`)
+	}
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	earlier := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	pending := func(deadline string) map[string]string {
+		tags := ourTags("ns", "claim", "uid-1")
+		tags[tagPendingDeletion] = deadline
+		return tags
+	}
+
+	tests := []struct {
+		name        string
+		period      time.Duration
+		annotations map[string]string
+		tags        map[string]string
+		policy      *string
+		wantRetain  bool
+		wantErr     bool
+		// state of the bucket once done
+		wantDenied, wantPending, wantRetained bool
+		wantEvent                             string
+	}{
+		{
+			name:   "no grace period",
+			tags:   ourTags("ns", "claim", "uid-1"),
+			policy: policy(other),
+		},
+		{
+			name:        "deletion already started",
+			period:      period,
+			annotations: map[string]string{annotationDeletion: "{}"},
+			tags:        ourTags("ns", "claim", "uid-1"),
+			policy:      policy(other),
+		},
+		{
+			name:        "grace period starts",
+			period:      period,
+			tags:        ourTags("ns", "claim", "uid-1"),
+			policy:      policy(other),
+			wantErr:     true,
+			wantDenied:  true,
+			wantPending: true,
+			wantEvent:   "BucketPendingDeletion",
+		},
+		{
+			name:        "grace period starts without bucket policy",
+			period:      period,
+			tags:        ourTags("ns", "claim", "uid-1"),
+			wantErr:     true,
+			wantDenied:  true,
+			wantPending: true,
+			wantEvent:   "BucketPendingDeletion",
+		},
+		{
+			name:        "within the grace period",
+			period:      period,
+			annotations: map[string]string{annotationDeleteAfter: later},
+			tags:        pending(later),
+			policy:      policy(other, deny),
+			wantErr:     true,
+			wantDenied:  true,
+			wantPending: true,
+		},
+		{
+			name:        "grace period over",
+			period:      period,
+			annotations: map[string]string{annotationDeleteAfter: earlier},
+			tags:        pending(earlier),
+			policy:      policy(other, deny),
+		},
+		{
+			name:         "undeleted",
+			period:       period,
+			annotations:  map[string]string{annotationDeleteAfter: later, annotationUndelete: "true"},
+			tags:         pending(later),
+			policy:       policy(other, deny),
+			wantRetain:   true,
+			wantRetained: true,
+			wantEvent:    "BucketUndeleted",
+		},
+		{
+			name:        "undelete not true",
+			period:      period,
+			annotations: map[string]string{annotationDeleteAfter: later, annotationUndelete: "yes"},
+			tags:        pending(later),
+			policy:      policy(other, deny),
+			wantErr:     true,
+			wantDenied:  true,
+			wantPending: true,
+		},
+		{
+			name:        "invalid deadline",
+			period:      period,
+			annotations: map[string]string{annotationDeleteAfter: "tomorrow"},
+			tags:        pending("tomorrow"),
+			policy:      policy(other, deny),
+			wantErr:     true,
+			wantDenied:  true,
+			wantPending: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ob := &v1alpha1.ObjectBucket{ObjectMeta: metav1.ObjectMeta{Name: "obc-ns-claim", Annotations: tt.annotations}}
+			lib := libfake.NewSimpleClientset(ob)
+			f := &fakeS3{tags: tt.tags, policy: tt.policy}
+			recorder := record.NewFakeRecorder(10)
+			p := &awsS3Provisioner{
+				bucketName:        "bkt",
+				clusterID:         "cluster-a",
+				s3svc:             f,
+				libClientset:      lib,
+				recorder:          recorder,
+				deleter:           newBucketDeleter(lib),
+				deleteGracePeriod: tt.period,
+			}
+
+			retain, err := p.softDelete(ob)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("softDelete() error = %v, want error %v", err, tt.wantErr)
+			}
+			if retain != tt.wantRetain {
+				t.Errorf("softDelete() = %v, want %v", retain, tt.wantRetain)
+			}
+
+			doc := aws.StringValue(f.policy)
+			if denied := strings.Contains(doc, denyAllSid); denied != tt.wantDenied {
+				t.Errorf("bucket policy %s, want access denied %v", doc, tt.wantDenied)
+			}
+			if tt.policy != nil && !strings.Contains(doc, `"Sid":"other"`) {
+				t.Errorf("bucket policy %s lost the statement of another owner", doc)
+			}
+			deadline, pending := f.tags[tagPendingDeletion]
+			if pending != tt.wantPending {
+				t.Errorf("tags %v, want pending deletion %v", f.tags, tt.wantPending)
+			}
+			if _, retained := f.tags[tagRetained]; retained != tt.wantRetained {
+				t.Errorf("tags %v, want retained %v", f.tags, tt.wantRetained)
+			}
+			if f.tags[tagClusterID] != "cluster-a" {
+				t.Errorf("tags %v lost the ownership tags", f.tags)
+			}
+
+			// the deadline is recorded in the OB and tagged once
+			saved, err := lib.ObjectbucketV1alpha1().ObjectBuckets().Get(ob.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("getting OB: %v", err)
+			}
+			if pending && saved.Annotations[annotationDeleteAfter] != deadline {
+				t.Errorf("OB deadline %q, bucket deadline %q", saved.Annotations[annotationDeleteAfter], deadline)
+			}
+			if tt.wantEvent == "BucketPendingDeletion" {
+				d, err := time.Parse(time.RFC3339, deadline)
+				if err != nil || d.Before(time.Now().Add(period-time.Minute)) || d.After(time.Now().Add(period)) {
+					t.Errorf("deadline %q, want in %v", deadline, period)
+				}
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if tt.wantEvent == "" || !strings.Contains(event, tt.wantEvent) {
+					t.Errorf("event %q, want %q", event, tt.wantEvent)
+				}
+			default:
+				if tt.wantEvent != "" {
+					t.Errorf("no event, want %q", tt.wantEvent)
+				}
+			}
+		})
+	}
+}
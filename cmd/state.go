@@ -0,0 +1,214 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+)
+
+// Keys of the provisioning outcome recorded in the OB's AdditionalState.
+// OBs without obStateVersion were provisioned before everything was
+// recorded and are torn down using their storage class.
+const (
+	obStateVersion           = "SchemaVersion"
+	obStatePolicyName        = "PolicyName"
+	obStateAccessKeys        = "AccessKeyIds"
+	obStatePolicyMode        = "PolicyMode"
+	obStateCredSource        = "CredentialSource"
+	obStateRegion            = "Region"
+	obStateS3Endpoint        = "S3Endpoint"
+	obStateIAMEndpoint       = "IAMEndpoint"
+	obStateOwnerSecret       = "OwnerSecret"
+	obStateStoragePolicy     = "StoragePolicyId"
+	obStateStoragePolicyName = "StoragePolicyName"
+	obStateDeleteGracePeriod = "DeleteGracePeriod"
+	obStateDeleteOnlyIfEmpty = "DeleteOnlyIfEmpty"
+	obStateRetainData        = "RetainData"
+	obStateAdopted           = "Adopted"
+	currentObStateVersion    = "2"
+)
+
+// Policy modes, how the bucket claim user was given access to the bucket.
+const (
+	// an IAM managed policy attached to a user created for the claim
+	policyModeManaged = "managed"
+	// statements in the bucket policy for the principal in the user secret
+	policyModeBucketPolicy = "bucketPolicy"
+	// none, the user secret's or owner's credentials are used as they are
+	policyModeNone = "none"
+)
+
+// Credential sources, where the access keys in the claim's secret came from.
+const (
+	credSourceIAMUser    = "iamUser"
+	credSourceUserSecret = "userSecret"
+	credSourceOwner      = "owner"
+)
+
+// policyMode returns how access to the bucket was granted.
+func (p *awsS3Provisioner) policyMode() string {
+	switch {
+	case p.bktCreateUser == "yes":
+		return policyModeManaged
+	case p.bktPolicySid != "":
+		return policyModeBucketPolicy
+	}
+	return policyModeNone
+}
+
+// obState returns everything created when provisioning, to be recorded in
+// the OB's AdditionalState.
+func (p *awsS3Provisioner) obState() map[string]string {
+
+	state := map[string]string{
+		obStateVersion:       currentObStateVersion,
+		obStateARN:           p.bktUserPolicyArn,
+		obStateUser:          p.bktUserName,
+		obStatePolicy:        p.bktPolicySid,
+		obStatePolicyMode:    p.policyMode(),
+		obStateCredSource:    p.bktCredSource,
+		obStateRegion:        p.region,
+		obStateOwnerSecret:   p.bktOwnerSecret,
+		obStateStoragePolicy: p.bktStoragePolicyId,
+	}
+	if p.bktStoragePolicyName != "" {
+		state[obStateStoragePolicyName] = p.bktStoragePolicyName
+	}
+	if p.deleteGracePeriod != 0 {
+		state[obStateDeleteGracePeriod] = p.deleteGracePeriod.String()
+	}
+	if p.deleteOnlyIfEmpty {
+		state[obStateDeleteOnlyIfEmpty] = "yes"
+	}
+	if p.retainData {
+		state[obStateRetainData] = "yes"
+	}
+	if p.bktAdopted {
+		state[obStateAdopted] = "yes"
+	}
+	if p.policyMode() == policyModeManaged {
+		// the policy is named after the user
+		state[obStatePolicyName] = p.bktUserName
+		state[obStateAccessKeys] = p.bktUserAccessId
+	}
+	if p.s3Endpoint != nil {
+		state[obStateS3Endpoint] = p.s3Endpoint.String()
+	}
+	if p.iamEndpoint != nil {
+		state[obStateIAMEndpoint] = p.iamEndpoint.String()
+	}
+	return state
+}
+
+// setFromObState sets the receiver fields from the state recorded in the
+// OB and creates the sessions and services needed for teardown. OBs which
+// predate the recorded state fall back on their current storage class.
+func (p *awsS3Provisioner) setFromObState(ob *v1alpha1.ObjectBucket) error {
+
+	state := ob.Spec.AdditionalState
+	p.bucketName = ob.Spec.Endpoint.BucketName
+	p.bktUserPolicyArn = state[obStateARN]
+	p.bktUserName = state[obStateUser]
+	p.bktPolicySid = state[obStatePolicy]
+
+	if state[obStateVersion] == "" {
+		glog.V(2).Infof("OB %q has no recorded state, using storage class %q", ob.Name, ob.Spec.StorageClassName)
+		sc, err := p.getClassByNameForBucket(ob.Spec.StorageClassName)
+		if err != nil {
+			return fmt.Errorf("failed to get storage class for OB %q: %v", ob.Name, err)
+		}
+		err = p.setSessionAndService(sc)
+		if err != nil {
+			return fmt.Errorf("error using OB %q: %v", ob.Name, err)
+		}
+		p.setCreateBucketUserOptions(sc)
+		p.setDeletionOptions(sc.Parameters)
+		p.deleteGracePeriod, err = getDeleteGracePeriod(sc.Parameters)
+		return err
+	}
+
+	p.bktCreateUser = "no"
+	if state[obStatePolicyMode] == policyModeManaged {
+		p.bktCreateUser = "yes"
+	}
+	p.bktUserAccessId = state[obStateAccessKeys]
+	p.bktCredSource = state[obStateCredSource]
+	p.bktStoragePolicyId = state[obStateStoragePolicy]
+	p.bktStoragePolicyName = state[obStateStoragePolicyName]
+	p.deleteOnlyIfEmpty = state[obStateDeleteOnlyIfEmpty] == "yes"
+	p.retainData = state[obStateRetainData] == "yes"
+	if v := state[obStateDeleteGracePeriod]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q in OB %q: %v", obStateDeleteGracePeriod, v, ob.Name, err)
+		}
+		p.deleteGracePeriod = d
+	}
+
+	err := p.setSessionAndServiceFromState(ob)
+	if err != nil {
+		return fmt.Errorf("error using OB %q: %v", ob.Name, err)
+	}
+	return nil
+}
+
+// Create the AWS session and S3 service from the OB's recorded state and
+// store them to the receiver.
+func (p *awsS3Provisioner) setSessionAndServiceFromState(ob *v1alpha1.ObjectBucket) error {
+
+	state := ob.Spec.AdditionalState
+	glog.V(2).Infof("Creating S3 session based on OB %q", ob.Name)
+
+	var err error
+	secret := strings.SplitN(state[obStateOwnerSecret], "/", 2)
+	if len(secret) != 2 {
+		err = p.setDefaultSessions()
+	} else {
+		var s3URL, iamURL *url.URL
+		if s3URL, err = parseStateURL(state[obStateS3Endpoint]); err != nil {
+			return err
+		}
+		if iamURL, err = parseStateURL(state[obStateIAMEndpoint]); err != nil {
+			return err
+		}
+		err = p.awsSession(fmt.Sprintf("OB %q", ob.Name), state[obStateRegion], secret[0], secret[1], s3URL, iamURL)
+	}
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %v", err)
+	}
+
+	p.s3svc = s3.New(p.s3Session)
+	p.iamsvc = awsuser.New(p.iamSession)
+	return nil
+}
+
+// parseStateURL parses a recorded endpoint, which is empty if the default
+// endpoint was used.
+func parseStateURL(v string) (*url.URL, error) {
+	if v == "" {
+		return nil, nil
+	}
+	return url.Parse(v)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storageV1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// storage class parameters
+	scStoragePolicyID      = "storagePolicyId"
+	scStoragePolicyName    = "storagePolicyName"
+	scAdminEndpoint        = "adminEndpoint"
+	scAdminSecretName      = "adminSecretName"
+	scAdminSecretNamespace = "adminSecretNamespace"
+	scAdminInsecure        = "adminInsecureSkipVerify"
+	// keys of the HyperStore Admin API credentials in the admin secret
+	adminUserField     = "username"
+	adminPasswordField = "password"
+	// Admin API path listing the storage policies
+	adminListPolicyPath = "/bppolicy/listpolicy"
+	// status of storage policies buckets can be created with
+	storagePolicyActive = "ACTIVE"
+
+	storagePolicyCacheTTL = 5 * time.Minute
+	adminAPITimeout       = 30 * time.Second
+)
+
+// storagePolicy is a HyperStore storage policy as returned by the Admin API.
+type storagePolicy struct {
+	PolicyID   string `json:"policyId"`
+	PolicyName string `json:"policyName"`
+	Status     string `json:"status"`
+}
+
+// storagePolicyCache holds the storage policies of each Admin API endpoint,
+// so they aren't listed for every claim.
+type storagePolicyCache struct {
+	sync.Mutex
+	entries map[string]*storagePolicyCacheEntry
+	// listings in progress, shared by the callers needing them
+	fetches map[string]*storagePolicyFetch
+}
+
+type storagePolicyCacheEntry struct {
+	policies []storagePolicy
+	fetched  time.Time
+}
+
+// storagePolicyFetch is a listing of an endpoint's policies, done once
+// done is closed.
+type storagePolicyFetch struct {
+	done     chan struct{}
+	policies []storagePolicy
+	err      error
+}
+
+var storagePolicies = &storagePolicyCache{
+	entries: map[string]*storagePolicyCacheEntry{},
+	fetches: map[string]*storagePolicyFetch{},
+}
+
+// get returns the cached policies of the endpoint, calling list if they
+// are missing, expired or refresh is set. The cache isn't locked while
+// listing, so a slow endpoint only holds up the callers waiting for its
+// policies, which share a single listing.
+func (c *storagePolicyCache) get(endpoint string, refresh bool, list func() ([]storagePolicy, error)) ([]storagePolicy, error) {
+
+	c.Lock()
+	e := c.entries[endpoint]
+	if e != nil && !refresh && time.Since(e.fetched) < storagePolicyCacheTTL {
+		c.Unlock()
+		return e.policies, nil
+	}
+	f, ok := c.fetches[endpoint]
+	if ok {
+		c.Unlock()
+		<-f.done
+		return f.policies, f.err
+	}
+	f = &storagePolicyFetch{done: make(chan struct{})}
+	c.fetches[endpoint] = f
+	c.Unlock()
+
+	f.policies, f.err = list()
+
+	c.Lock()
+	delete(c.fetches, endpoint)
+	if f.err == nil {
+		c.entries[endpoint] = &storagePolicyCacheEntry{policies: f.policies, fetched: time.Now()}
+	}
+	c.Unlock()
+	close(f.done)
+	return f.policies, f.err
+}
+
+// getStoragePolicy returns the id and name of the storage policy set in the
+// storage class, resolving storagePolicyName through the Admin API. Both
+// are empty if the storage class doesn't set one.
+func getStoragePolicy(c kubernetes.Interface, sc *storageV1.StorageClass) (string, string, error) {
+
+	id, name := sc.Parameters[scStoragePolicyID], sc.Parameters[scStoragePolicyName]
+	if name == "" {
+		return id, "", nil
+	}
+	if id != "" {
+		return "", "", fmt.Errorf("storage class %q sets both %s and %s", sc.Name, scStoragePolicyID, scStoragePolicyName)
+	}
+	id, err := resolveStoragePolicy(c, sc, name)
+	if err != nil {
+		return "", "", err
+	}
+	return id, name, nil
+}
+
+// recordedStoragePolicy returns the id and name of the storage policy
+// recorded in the OB of a claim provisioned before, if any.
+func (p *awsS3Provisioner) recordedStoragePolicy(obc *v1alpha1.ObjectBucketClaim) (string, string, bool) {
+
+	if obc.Spec.ObjectBucketName == "" || p.libClientset == nil {
+		return "", "", false
+	}
+	ob, err := p.libClientset.ObjectbucketV1alpha1().ObjectBuckets().Get(obc.Spec.ObjectBucketName, metav1.GetOptions{})
+	if err != nil {
+		return "", "", false
+	}
+	id, ok := ob.Spec.AdditionalState[obStateStoragePolicy]
+	return id, ob.Spec.AdditionalState[obStateStoragePolicyName], ok
+}
+
+// resolveStoragePolicy returns the id of the active storage policy with the
+// name, using the Admin API endpoint and credentials in the storage class.
+func resolveStoragePolicy(c kubernetes.Interface, sc *storageV1.StorageClass, name string) (string, error) {
+
+	endpoint, err := getApiURL(sc, scAdminEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if endpoint == nil {
+		return "", fmt.Errorf("storage class %q sets %s without %s", sc.Name, scStoragePolicyName, scAdminEndpoint)
+	}
+	ns, secretName := sc.Parameters[scAdminSecretNamespace], sc.Parameters[scAdminSecretName]
+	if ns == "" || secretName == "" {
+		return "", fmt.Errorf("storage class %q sets %s without %s and %s", sc.Name, scStoragePolicyName,
+			scAdminSecretName, scAdminSecretNamespace)
+	}
+	list := func() ([]storagePolicy, error) {
+		secret, err := c.CoreV1().Secrets(ns).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get Admin API secret \"%s/%s\": %v", ns, secretName, err)
+		}
+		return listStoragePolicies(endpoint, string(secret.Data[adminUserField]), string(secret.Data[adminPasswordField]),
+			sc.Parameters[scAdminInsecure] == "yes")
+	}
+
+	// a policy missing from the cache may have been created since
+	for _, refresh := range []bool{false, true} {
+		policies, err := storagePolicies.get(endpoint.String(), refresh, list)
+		if err != nil {
+			return "", err
+		}
+		for _, policy := range policies {
+			if policy.PolicyName != name {
+				continue
+			}
+			if policy.Status != storagePolicyActive {
+				return "", fmt.Errorf("storage policy %q is %s, not %s", name, policy.Status, storagePolicyActive)
+			}
+			return policy.PolicyID, nil
+		}
+	}
+	return "", fmt.Errorf("storage policy %q does not exist at %s", name, endpoint)
+}
+
+// listStoragePolicies lists the storage policies using the Admin API.
+func listStoragePolicies(endpoint *url.URL, user, password string, insecure bool) ([]storagePolicy, error) {
+
+	client := &http.Client{Timeout: adminAPITimeout}
+	if insecure {
+		// the Admin API is commonly served with a self-signed certificate
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint.String()+adminListPolicyPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(user, password)
+
+	glog.V(2).Infof("listing storage policies at %s", endpoint)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing storage policies at %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing storage policies at %s: %s", endpoint, resp.Status)
+	}
+
+	var policies []storagePolicy
+	err = json.NewDecoder(resp.Body).Decode(&policies)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding storage policies from %s: %v", endpoint, err)
+	}
+	return policies, nil
+}
+
+// validateStoragePolicies checks that the storage policies named in the
+// storage classes of this provisioner exist and are active, reporting the
+// ones which aren't in the log and in events on their storage class.
+func validateStoragePolicies(c *kubernetes.Clientset, recorder record.EventRecorder) {
+
+	classes, err := c.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("unable to list storage classes to validate storage policies: %v", err)
+		return
+	}
+	for i := range classes.Items {
+		sc := &classes.Items[i]
+		if sc.Provisioner != provisionerName || sc.Parameters[scStoragePolicyName] == "" {
+			continue
+		}
+		_, _, err := getStoragePolicy(c, sc)
+		if err != nil {
+			glog.Errorf("storage class %q has an invalid storage policy, claims using it will fail: %v", sc.Name, err)
+			recorder.Eventf(sc, corev1.EventTypeWarning, "InvalidStoragePolicy", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsuser "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// keys of the tags set on the entities the operator creates
+	tagPrefix       = "cloudian-s3-operator/"
+	tagClusterID    = tagPrefix + "cluster-id"
+	tagOBCNamespace = tagPrefix + "obc-namespace"
+	tagOBCName      = tagPrefix + "obc-name"
+	tagOBCUID       = tagPrefix + "obc-uid"
+	tagStorageClass = tagPrefix + "storage-class"
+	tagProvisioner  = tagPrefix + "provisioner"
+	tagCreated      = tagPrefix + "created"
+
+	// storage class parameter selecting the labels of the storage class
+	// and OBC copied to the bucket's tags, without the prefix
+	scTagLabelPrefix = "tagLabelPrefix"
+	// limits of S3 tags
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+
+	// OB annotation which, set to "true", allows deleting a bucket which
+	// has no ownership tags, such as one created before buckets were tagged
+	annotationSkipOwnership = "cloudian-s3.io/skip-ownership-check"
+
+	defaultIAMPathPrefix = "/cloudian-s3-operator/"
+	errNoSuchTagSet      = "NoSuchTagSet"
+)
+
+// Return the UID of the kube-system namespace, which is used to identify
+// the cluster when no cluster id is configured.
+func defaultClusterID(c *kubernetes.Clientset) (string, error) {
+
+	ns, err := c.CoreV1().Namespaces().Get(metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to Get namespace %q: %v", metav1.NamespaceSystem, err)
+	}
+	return string(ns.UID), nil
+}
+
+// iamPath returns the IAM path of the users and policies created by the
+// operator, the configured path prefix followed by the cluster id.
+func (p *awsS3Provisioner) iamPath() string {
+
+	path := p.iamPathPrefix
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	if p.clusterID != "" {
+		path += p.clusterID + "/"
+	}
+	return path
+}
+
+// ownerTags returns the tags identifying the cluster, claim and storage
+// class an entity was created for.
+func (p *awsS3Provisioner) ownerTags(options *apibkt.BucketOptions) map[string]string {
+
+	obc := options.ObjectBucketClaim
+	return map[string]string{
+		tagClusterID:    p.clusterID,
+		tagOBCNamespace: obc.Namespace,
+		tagOBCName:      obc.Name,
+		tagOBCUID:       string(obc.UID),
+		tagStorageClass: obc.Spec.StorageClassName,
+		tagProvisioner:  provisionerName,
+		tagCreated:      time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// labelTags returns the tags for the labels with the prefix, in order of
+// precedence. Labels named like the operator's own tags are ignored.
+func labelTags(prefix string, labelSets ...map[string]string) map[string]string {
+
+	tags := map[string]string{}
+	if prefix == "" {
+		return tags
+	}
+	for _, labels := range labelSets {
+		for k, v := range labels {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(k, prefix)
+			if key == "" || strings.HasPrefix(key, tagPrefix) ||
+				len(key) > maxTagKeyLen || len(v) > maxTagValueLen {
+				glog.Warningf("ignoring label %q, not a valid bucket tag", k)
+				continue
+			}
+			tags[key] = v
+		}
+	}
+	return tags
+}
+
+// bucketTags returns the tags of a bucket: the user tags, replaced by
+// their new values, and the owner tags.
+func bucketTags(ownerTags, userTags map[string]string) map[string]string {
+
+	tags := map[string]string{}
+	for k, v := range userTags {
+		tags[k] = v
+	}
+	for k, v := range ownerTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// ownerTagsOf returns the operator's own tags from tags.
+func ownerTagsOf(tags map[string]string) map[string]string {
+
+	owner := map[string]string{}
+	for k, v := range tags {
+		if strings.HasPrefix(k, tagPrefix) {
+			owner[k] = v
+		}
+	}
+	return owner
+}
+
+// ownedByCluster returns true if the tags identify an entity created by
+// this provisioner for this cluster.
+func (p *awsS3Provisioner) ownedByCluster(tags map[string]string) bool {
+	return tags[tagProvisioner] == provisionerName && tags[tagClusterID] == p.clusterID
+}
+
+// checkBucketOwner returns an error unless the bucket's tags allow using it
+// for a claim, or deleting it for the OB if one is given:
+//   - buckets tagged by another cluster or provisioner are never used
+//   - buckets tagged by this cluster are shared between its claims, but are
+//     only deleted for the claim they were provisioned for, matched on its
+//     UID or, if tagged before UIDs were recorded, its namespace and name
+//   - untagged buckets, created before buckets were tagged or outside of the
+//     operator, are shared too, but only deleted if the OB is annotated with
+//     the override
+//
+// Refusing to delete marks the OB Failed and emits an event.
+func (p *awsS3Provisioner) checkBucketOwner(bktName string, deleting *v1alpha1.ObjectBucket) error {
+
+	tags, err := p.getBucketTags(bktName)
+	if err != nil {
+		if isNoSuchBucketError(err) {
+			return nil
+		}
+		return fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+
+	_, tagged := tags[tagClusterID]
+	if tagged && !p.ownedByCluster(tags) {
+		err = fmt.Errorf("bucket %q belongs to cluster %q and provisioner %q, not this one",
+			bktName, tags[tagClusterID], tags[tagProvisioner])
+		if deleting != nil {
+			return p.refuseDeletion(deleting, "BucketOwnerMismatch", err.Error())
+		}
+		return err
+	}
+	if deleting == nil {
+		return nil
+	}
+
+	ob := deleting
+	if !tagged {
+		if ob.Annotations[annotationSkipOwnership] == "true" {
+			glog.Warningf("bucket %q has no ownership tags, deleting it as OB %q is annotated with %s",
+				bktName, ob.Name, annotationSkipOwnership)
+			return nil
+		}
+		return p.refuseDeletion(ob, "BucketOwnershipUnknown",
+			fmt.Sprintf("bucket %q has no ownership tags, annotate the ObjectBucket with %s=true to delete it anyway",
+				bktName, annotationSkipOwnership))
+	}
+	ref := ob.Spec.ClaimRef
+	switch {
+	case ref == nil:
+		err = fmt.Errorf("OB %q has no claim reference", ob.Name)
+	case !provisionedForClaim(tags, ref):
+		err = fmt.Errorf("belongs to claim \"%s/%s\" with UID %q, not \"%s/%s\" with UID %q",
+			tags[tagOBCNamespace], tags[tagOBCName], tags[tagOBCUID], ref.Namespace, ref.Name, ref.UID)
+	}
+	if err != nil {
+		return p.refuseDeletion(ob, "BucketOwnerMismatch",
+			fmt.Sprintf("bucket %q is not owned by this ObjectBucket: %v", bktName, err))
+	}
+	return nil
+}
+
+// checkUserOwner returns an error unless the IAM user's tags show it was
+// created by this cluster for the claim.
+func (p *awsS3Provisioner) checkUserOwner(uname string, options *apibkt.BucketOptions) error {
+
+	tags, err := p.getUserTags(uname)
+	if err != nil {
+		return err
+	}
+	obc := options.ObjectBucketClaim
+	if !p.ownedByCluster(tags) || tags[tagOBCUID] != string(obc.UID) {
+		return fmt.Errorf("IAM user %q was not created for OBC \"%s/%s\"", uname, obc.Namespace, obc.Name)
+	}
+	return nil
+}
+
+// getUserTags returns the IAM user's tags.
+func (p *awsS3Provisioner) getUserTags(uname string) (map[string]string, error) {
+
+	out, err := p.iamsvc.ListUserTags(&awsuser.ListUserTagsInput{UserName: aws.String(uname)})
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of user %q: %v", uname, err)
+	}
+	tags := map[string]string{}
+	for _, t := range out.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
+// provisionedForClaim returns true if the tags identify the claim, by UID
+// or, for entities tagged before the UID was recorded, by namespace and
+// name.
+func provisionedForClaim(tags map[string]string, ref *corev1.ObjectReference) bool {
+
+	if ref == nil {
+		return false
+	}
+	if uid := tags[tagOBCUID]; uid != "" {
+		return uid == string(ref.UID)
+	}
+	return tags[tagOBCNamespace] == ref.Namespace && tags[tagOBCName] == ref.Name
+}
+
+// iamTags converts tags to IAM tags, sorted by key.
+func iamTags(tags map[string]string) []*awsuser.Tag {
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	iamTags := make([]*awsuser.Tag, 0, len(keys))
+	for _, k := range keys {
+		iamTags = append(iamTags, &awsuser.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return iamTags
+}
+
+// tagsDescription renders tags as a policy description. IAM policies can't
+// be tagged by the version of the aws sdk we use so the owner tags are
+// recorded in the (immutable) description instead.
+func tagsDescription(tags map[string]string) string {
+
+	pairs := []string{}
+	for _, t := range iamTags(tags) {
+		pairs = append(pairs, aws.StringValue(t.Key)+"="+aws.StringValue(t.Value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseTagsDescription is the reverse of tagsDescription. Descriptions not
+// written by the operator result in an empty map.
+func parseTagsDescription(desc string) map[string]string {
+
+	tags := map[string]string{}
+	for _, pair := range strings.Split(desc, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], tagPrefix) {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return tags
+}
+
+// tagBucket replaces the bucket's tag set with tags.
+func (p *awsS3Provisioner) tagBucket(bktName string, tags map[string]string) error {
+
+	tagSet := []*s3.Tag{}
+	for _, t := range iamTags(tags) {
+		tagSet = append(tagSet, &s3.Tag{Key: t.Key, Value: t.Value})
+	}
+
+	glog.V(2).Infof("tagging bucket %q", bktName)
+	_, err := p.s3svc.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket:  aws.String(bktName),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	if err != nil {
+		return fmt.Errorf("error tagging bucket %q: %v", bktName, err)
+	}
+	return nil
+}
+
+// updateBucketTags replaces the user tags of the bucket, keeping the owner
+// tags it was created with.
+func (p *awsS3Provisioner) updateBucketTags(bktName string, userTags map[string]string) error {
+
+	old, err := p.getBucketTags(bktName)
+	if err != nil {
+		return fmt.Errorf("error getting tags of bucket %q: %v", bktName, err)
+	}
+	tags := bucketTags(ownerTagsOf(old), userTags)
+	if reflect.DeepEqual(old, tags) {
+		return nil
+	}
+	return p.tagBucket(bktName, tags)
+}
+
+// getBucketTags returns the bucket's tags, or an empty map if the bucket
+// isn't tagged.
+func (p *awsS3Provisioner) getBucketTags(bktName string) (map[string]string, error) {
+
+	tags := map[string]string{}
+	out, err := p.s3svc.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String(bktName)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errNoSuchTagSet {
+			return tags, nil
+		}
+		return nil, err
+	}
+	for _, t := range out.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
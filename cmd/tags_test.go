@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ourTags returns the tags of a bucket provisioned by this cluster for the
+// claim ns/name with the UID, without the UID if it's empty.
+func ourTags(ns, name, uid string) map[string]string {
+	tags := map[string]string{
+		tagClusterID:    "cluster-a",
+		tagProvisioner:  provisionerName,
+		tagOBCNamespace: ns,
+		tagOBCName:      name,
+	}
+	if uid != "" {
+		tags[tagOBCUID] = uid
+	}
+	return tags
+}
+
+func TestCheckBucketOwner(t *testing.T) {
+
+	ref := &corev1.ObjectReference{Namespace: "ns", Name: "claim", UID: "uid-1"}
+	otherCluster := ourTags("ns", "claim", "uid-1")
+	otherCluster[tagClusterID] = "cluster-b"
+	otherProvisioner := ourTags("ns", "claim", "uid-1")
+	otherProvisioner[tagProvisioner] = "example.com/bucket"
+	skip := map[string]string{annotationSkipOwnership: "true"}
+
+	tests := []struct {
+		name        string
+		s3          *fakeS3
+		annotations map[string]string
+		ref         *corev1.ObjectReference
+		// errors using the bucket, and deleting it for the OB
+		wantErr, wantDeleteErr bool
+	}{
+		{"bucket already deleted", &fakeS3{noBucket: true}, nil, ref, false, false},
+		{"same claim UID", &fakeS3{tags: ourTags("ns", "claim", "uid-1")}, nil, ref, false, false},
+		{"other claim UID of the same name", &fakeS3{tags: ourTags("ns", "claim", "uid-2")}, nil, ref, false, true},
+		{"another claim of ours", &fakeS3{tags: ourTags("ns", "other", "uid-2")}, nil, ref, false, true},
+		{"other cluster", &fakeS3{tags: otherCluster}, nil, ref, true, true},
+		{"other cluster with override", &fakeS3{tags: otherCluster}, skip, ref, true, true},
+		{"other provisioner", &fakeS3{tags: otherProvisioner}, nil, ref, true, true},
+		{"legacy tags of the same claim", &fakeS3{tags: ourTags("ns", "claim", "")}, nil, ref, false, false},
+		{"legacy tags of another claim", &fakeS3{tags: ourTags("ns", "other", "")}, nil, ref, false, true},
+		{"no claim reference", &fakeS3{tags: ourTags("ns", "claim", "uid-1")}, nil, nil, false, true},
+		{"untagged", &fakeS3{}, nil, ref, false, true},
+		{"untagged with override", &fakeS3{}, skip, ref, false, false},
+		{"untagged with override not true", &fakeS3{}, map[string]string{annotationSkipOwnership: "yes"}, ref, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsS3Provisioner{bucketName: "bkt", clusterID: "cluster-a", s3svc: tt.s3}
+			err := p.checkBucketOwner("bkt", nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkBucketOwner() error = %v, want error %v", err, tt.wantErr)
+			}
+			ob := &v1alpha1.ObjectBucket{
+				ObjectMeta: metav1.ObjectMeta{Name: "obc-ns-claim", Annotations: tt.annotations},
+				Spec:       v1alpha1.ObjectBucketSpec{ClaimRef: tt.ref},
+			}
+			err = p.checkBucketOwner("bkt", ob)
+			if (err != nil) != tt.wantDeleteErr {
+				t.Errorf("checkBucketOwner(ob) error = %v, want error %v", err, tt.wantDeleteErr)
+			}
+		})
+	}
+}
@@ -17,10 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
-	"math/rand"
+	"math/big"
 	"net/url"
-	"time"
+	"regexp"
+	"strings"
+	"text/template"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/iam"
@@ -28,9 +31,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/golang/glog"
 	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned"
+	libscheme "github.com/kube-object-storage/lib-bucket-provisioner/pkg/client/clientset/versioned/scheme"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	corev1 "k8s.io/api/core/v1"
 	storageV1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 // Return the storage class for a given name.
@@ -45,11 +57,21 @@ func (p *awsS3Provisioner) getClassByNameForBucket(className string) (*storageV1
 	return class, nil
 }
 
+// Return a recorder for the events the operator emits, on core objects and
+// on ObjectBuckets.
+func newEventRecorder(c *kubernetes.Clientset) record.EventRecorder {
+
+	utilruntime.Must(libscheme.AddToScheme(scheme.Scheme))
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: operatorName})
+}
+
 // Return the region name from the passed in storage class.
 func getRegion(sc *storageV1.StorageClass) string {
 
-	const scRegionKey = "region"
-	return sc.Parameters[scRegionKey]
+	return sc.Parameters[scRegion]
 }
 
 // Return the secret namespace and name from the passed storage class.
@@ -96,7 +118,7 @@ func getIAMApiURL(sc *storageV1.StorageClass) (*url.URL, error) {
 }
 
 // Get the secret and set the receiver to the accessKeyId and secretKey.
-func credsFromSecret(c *kubernetes.Clientset, ns, name string) (accessKeyId, secretKey string, err error) {
+func credsFromSecret(c kubernetes.Interface, ns, name string) (accessKeyId, secretKey string, err error) {
 
 	nsName := fmt.Sprintf("%s/%s", ns, name)
 	glog.V(2).Infof("getting secret %q...", nsName)
@@ -115,34 +137,151 @@ func credsFromSecret(c *kubernetes.Clientset, ns, name string) (accessKeyId, sec
 	return
 }
 
-func randomString(n int) string {
+// randomString returns n characters chosen using a cryptographically secure
+// random generator.
+func randomString(n int) (string, error) {
 
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	var letterRunes = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 	b := make([]rune, n)
+	max := big.NewInt(int64(len(letterRunes)))
 	for i := range b {
-		b[i] = letterRunes[r.Intn(len(letterRunes))]
+		r, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letterRunes[r.Int64()]
 	}
-	return string(b)
+	return string(b), nil
 }
 
-func (p *awsS3Provisioner) createUserName(bkt string) string {
+// userNameFields are the fields available to a storage class's
+// userNameTemplate.
+type userNameFields struct {
+	Namespace    string
+	Claim        string
+	Bucket       string
+	StorageClass string
+	Rand         string
+}
+
+// getUserNameTemplate returns the template used to generate IAM user names
+// from the storage class's "userNameTemplate", defaulting to the bucket
+// name followed by a random suffix.
+func getUserNameTemplate(params map[string]string) (*template.Template, error) {
+
+	const scUserNameTemplate = "userNameTemplate"
+	text, ok := params[scUserNameTemplate]
+	if !ok {
+		text = "{{.Bucket}}-{{.Rand}}"
+	}
+	tmpl, err := template.New(scUserNameTemplate).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", scUserNameTemplate, text, err)
+	}
+	err = checkUserNameTemplate(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", scUserNameTemplate, text, err)
+	}
+	return tmpl, nil
+}
+
+// checkUserNameTemplate renders the template with the longest values of
+// each field, so templates generating names over the IAM limit are caught
+// before a claim uses them. Templates must use .Rand, or every attempt to
+// find an unused name would generate the same one.
+func checkUserNameTemplate(tmpl *template.Template) error {
+
+	worst := userNameFields{
+		Namespace:    strings.Repeat("n", maxNamespaceLen),
+		Claim:        strings.Repeat("c", maxObjectNameLen),
+		Bucket:       strings.Repeat("b", maxUserBucketLen),
+		StorageClass: strings.Repeat("s", maxObjectNameLen),
+		Rand:         strings.Repeat("r", genUserLen),
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, worst); err != nil {
+		return err
+	}
+	if n := b.Len(); n > maxUserNameLen {
+		return fmt.Errorf("names generated for the longest namespace, claim and storage class names are %d characters, "+
+			"over the limit of %d, truncate fields such as {{printf \"%%.20s\" .Claim}}", n, maxUserNameLen)
+	}
+	if err := validUserName(b.String()); err != nil {
+		return err
+	}
+
+	worst.Rand = strings.Repeat("R", genUserLen)
+	var other strings.Builder
+	if err := tmpl.Execute(&other, worst); err != nil {
+		return err
+	}
+	if other.String() == b.String() {
+		return fmt.Errorf("template must use {{.Rand}} so names don't collide")
+	}
+	return nil
+}
+
+// userNameRegexp matches the characters allowed in an IAM user name.
+var userNameRegexp = regexp.MustCompile(`^[\w+=,.@-]+$`)
+
+// validUserName checks the name against the IAM user name rules.
+func validUserName(name string) error {
+
+	if len(name) == 0 || len(name) > maxUserNameLen {
+		return fmt.Errorf("user name %q must be 1 to %d characters long", name, maxUserNameLen)
+	}
+	if !userNameRegexp.MatchString(name) {
+		return fmt.Errorf("user name %q may only contain alphanumerics and '+=,.@_-'", name)
+	}
+	return nil
+}
+
+// createUserName generates a user name that doesn't yet exist from the
+// storage class's template. Gives up after maxUserAttempts collisions.
+func (p *awsS3Provisioner) createUserName(bkt string, options *apibkt.BucketOptions) (string, error) {
+
+	tmpl, err := getUserNameTemplate(options.Parameters)
+	if err != nil {
+		return "", err
+	}
+
 	// prefix is bucket name
-	if len(bkt) > maxBucketLen {
-		bkt = bkt[:(maxBucketLen - 1)]
+	if len(bkt) > maxUserBucketLen {
+		bkt = bkt[:maxUserBucketLen]
 	}
+	fields := userNameFields{
+		Namespace:    options.ObjectBucketClaim.Namespace,
+		Claim:        options.ObjectBucketClaim.Name,
+		Bucket:       bkt,
+		StorageClass: options.ObjectBucketClaim.Spec.StorageClassName,
+	}
+
+	for i := 1; i <= maxUserAttempts; i++ {
+		fields.Rand, err = randomString(genUserLen)
+		if err != nil {
+			return "", fmt.Errorf("error generating user name: %v", err)
+		}
+		var b strings.Builder
+		if err = tmpl.Execute(&b, fields); err != nil {
+			return "", fmt.Errorf("error generating user name: %v", err)
+		}
+		name := b.String()
+		if err = validUserName(name); err != nil {
+			return "", err
+		}
 
-	var userbool bool
-	name := ""
-	i := 0
-	for ok := true; ok; ok = userbool {
-		name = fmt.Sprintf("%s-%s", bkt, randomString(genUserLen))
-		userbool = p.checkIfUserExists(name)
-		i++
+		exists, err := p.checkIfUserExists(name)
+		if err != nil {
+			return "", fmt.Errorf("error checking if user %q exists: %v", name, err)
+		}
+		if !exists {
+			glog.V(2).Infof("Generated user %s after %v iterations", name, i)
+			return name, nil
+		}
+		glog.V(2).Infof("Generated user %s already exists", name)
 	}
-	glog.V(2).Infof("Generated user %s after %v iterations", name, i)
-	return name
+	return "", fmt.Errorf("unable to generate a unique user name for bucket %q in %d attempts", bkt, maxUserAttempts)
 }
 
 // isNoSuchBucketError tests the result of failed bucket deletion calls
@@ -172,3 +311,28 @@ func isNoSuchEntityError(err error) bool {
 	}
 	return false
 }
+
+// setOBAnnotation sets an annotation of the OB, retrying on conflicts.
+func setOBAnnotation(c versioned.Interface, obName, key, value string) error {
+	return setOBAnnotations(c, obName, map[string]string{key: value})
+}
+
+// setOBAnnotations sets annotations of the OB, retrying on conflicts.
+func setOBAnnotations(c versioned.Interface, obName string, annotations map[string]string) error {
+
+	obs := c.ObjectbucketV1alpha1().ObjectBuckets()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ob, err := obs.Get(obName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if ob.Annotations == nil {
+			ob.Annotations = map[string]string{}
+		}
+		for k, v := range annotations {
+			ob.Annotations[k] = v
+		}
+		_, err = obs.Update(ob)
+		return err
+	})
+}
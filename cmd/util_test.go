@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	apibkt "github.com/kube-object-storage/lib-bucket-provisioner/pkg/provisioner/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreateUserNameLongestBucket(t *testing.T) {
+
+	// the longest template checkUserNameTemplate accepts with the bucket
+	// name and the random suffix
+	text := "{{.Bucket}}-{{.Rand}}" + strings.Repeat("x", maxUserNameLen-maxUserBucketLen-genUserLen-1)
+	options := &apibkt.BucketOptions{
+		ObjectBucketClaim: &v1alpha1.ObjectBucketClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "claim"}},
+		Parameters:        map[string]string{"userNameTemplate": text},
+	}
+	if _, err := getUserNameTemplate(options.Parameters); err != nil {
+		t.Fatalf("getUserNameTemplate() error = %v", err)
+	}
+
+	p := &awsS3Provisioner{iamsvc: newFakeIAM()}
+	for _, n := range []int{maxUserBucketLen, maxBucketLen, 63} {
+		name, err := p.createUserName(strings.Repeat("b", n), options)
+		if err != nil {
+			t.Errorf("createUserName() of a %d character bucket error = %v", n, err)
+			continue
+		}
+		if len(name) != maxUserNameLen {
+			t.Errorf("createUserName() of a %d character bucket = %q, want %d characters", n, name, maxUserNameLen)
+		}
+	}
+
+	// a longer template is refused
+	options.Parameters["userNameTemplate"] = text + "x"
+	if _, err := getUserNameTemplate(options.Parameters); err == nil {
+		t.Errorf("getUserNameTemplate() of a template over the limit error = nil")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/golang/glog"
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	storageV1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	webhookStorageClassPath = "/validate-storageclass"
+	webhookClaimPath        = "/validate-objectbucketclaim"
+)
+
+// admissionValidator validates the object in an admission request.
+type admissionValidator func(req *admissionv1beta1.AdmissionRequest) error
+
+// serveWebhooks serves the validating admission webhooks over TLS until
+// the server fails.
+func serveWebhooks(c *kubernetes.Clientset, addr, certFile, keyFile string) error {
+
+	mux := http.NewServeMux()
+	mux.Handle(webhookStorageClassPath, admissionHandler(validateStorageClassRequest))
+	mux.Handle(webhookClaimPath, admissionHandler(func(req *admissionv1beta1.AdmissionRequest) error {
+		return validateClaimRequest(c, req)
+	}))
+	glog.Infof("serving admission webhooks on %s", addr)
+	server := &http.Server{Addr: addr, Handler: mux}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// admissionHandler decodes AdmissionReviews, validates their request and
+// answers with the result. The v1 and v1beta1 AdmissionReviews have the
+// same fields, so the request's apiVersion is echoed in the response.
+func admissionHandler(validate admissionValidator) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := admissionv1beta1.AdmissionReview{}
+		err := json.NewDecoder(r.Body).Decode(&review)
+		if err != nil || review.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		req := review.Request
+		resp := &admissionv1beta1.AdmissionResponse{UID: req.UID, Allowed: true}
+		if err := validate(req); err != nil {
+			glog.V(2).Infof("webhook: rejecting %s %q: %v", req.Kind.Kind, req.Name, err)
+			resp.Allowed = false
+			resp.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+				Message: err.Error(),
+			}
+		}
+		review.Request = nil
+		review.Response = resp
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&review); err != nil {
+			glog.Errorf("webhook: error writing AdmissionReview response: %v", err)
+		}
+	})
+}
+
+// validateStorageClassRequest validates the parameters of storage classes
+// of this provisioner.
+func validateStorageClassRequest(req *admissionv1beta1.AdmissionRequest) error {
+
+	sc := &storageV1.StorageClass{}
+	if err := json.Unmarshal(req.Object.Raw, sc); err != nil {
+		return fmt.Errorf("error decoding StorageClass: %v", err)
+	}
+	if sc.Provisioner != provisionerName {
+		return nil
+	}
+	return validateStorageClassParams(sc)
+}
+
+// validateClaimRequest validates OBCs using storage classes of this
+// provisioner. Claims of storage classes which don't exist yet are let
+// through, the bucket library reports them. Updates are only checked for
+// the fields they change, so claims stay updatable, and deletable, by the
+// bucket library when their storage class changes.
+func validateClaimRequest(c kubernetes.Interface, req *admissionv1beta1.AdmissionRequest) error {
+
+	obc := &v1alpha1.ObjectBucketClaim{}
+	if err := json.Unmarshal(req.Object.Raw, obc); err != nil {
+		return fmt.Errorf("error decoding ObjectBucketClaim: %v", err)
+	}
+	// the namespace isn't always set in the object of create requests
+	if obc.Namespace == "" {
+		obc.Namespace = req.Namespace
+	}
+	if obc.DeletionTimestamp != nil || obc.Spec.StorageClassName == "" {
+		return nil
+	}
+
+	var old *v1alpha1.ObjectBucketClaim
+	if req.Operation == admissionv1beta1.Update {
+		old = &v1alpha1.ObjectBucketClaim{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return fmt.Errorf("error decoding old ObjectBucketClaim: %v", err)
+		}
+		// metadata and status updates, such as the library's finalizer
+		if reflect.DeepEqual(old.Spec, obc.Spec) {
+			return nil
+		}
+	}
+
+	sc, err := c.StorageV1().StorageClasses().Get(obc.Spec.StorageClassName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting storage class %q: %v", obc.Spec.StorageClassName, err)
+	}
+	if sc.Provisioner != provisionerName {
+		return nil
+	}
+	return validateClaim(sc, obc, old)
+}
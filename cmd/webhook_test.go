@@ -0,0 +1,183 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kube-object-storage/lib-bucket-provisioner/pkg/apis/objectbucket.io/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	storageV1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// admissionRequest returns an admission request of the operation on obj,
+// replacing old for updates.
+func admissionRequest(kind string, op admissionv1beta1.Operation, obj, old interface{}) *admissionv1beta1.AdmissionRequest {
+
+	req := &admissionv1beta1.AdmissionRequest{
+		UID:       types.UID("req-1"),
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Operation: op,
+		Namespace: "apps",
+	}
+	req.Object.Raw, _ = json.Marshal(obj)
+	if old != nil {
+		req.OldObject.Raw, _ = json.Marshal(old)
+	}
+	return req
+}
+
+func TestAdmissionHandler(t *testing.T) {
+
+	sc := func(provisioner string, params map[string]string) *storageV1.StorageClass {
+		return &storageV1.StorageClass{Provisioner: provisioner, Parameters: params}
+	}
+
+	tests := []struct {
+		name     string
+		body     interface{}
+		wantCode int
+		// allowed, and the substring of the message when denied
+		wantAllowed bool
+		wantMsg     string
+	}{
+		{
+			name: "valid storage class",
+			body: &admissionv1beta1.AdmissionReview{Request: admissionRequest("StorageClass", admissionv1beta1.Create,
+				sc(provisionerName, map[string]string{"createBucketUser": "yes"}), nil)},
+			wantCode:    http.StatusOK,
+			wantAllowed: true,
+		},
+		{
+			name: "invalid storage class",
+			body: &admissionv1beta1.AdmissionReview{Request: admissionRequest("StorageClass", admissionv1beta1.Create,
+				sc(provisionerName, map[string]string{"createBucketUser": "true", "versioned": "yes"}), nil)},
+			wantCode: http.StatusOK,
+			wantMsg:  `invalid createBucketUser "true"`,
+		},
+		{
+			name: "storage class of another provisioner",
+			body: &admissionv1beta1.AdmissionReview{Request: admissionRequest("StorageClass", admissionv1beta1.Create,
+				sc("example.com/bucket", map[string]string{"versioned": "yes"}), nil)},
+			wantCode:    http.StatusOK,
+			wantAllowed: true,
+		},
+		{
+			name:     "review without request",
+			body:     &admissionv1beta1.AdmissionReview{},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "not a review",
+			body:     "[]",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := json.Marshal(tt.body)
+			w := httptest.NewRecorder()
+			admissionHandler(validateStorageClassRequest).ServeHTTP(w, httptest.NewRequest("POST", webhookStorageClassPath, bytes.NewReader(b)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			review := admissionv1beta1.AdmissionReview{}
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			resp := review.Response
+			if review.Request != nil || resp == nil || resp.UID != "req-1" {
+				t.Fatalf("response %s doesn't answer the request", w.Body.String())
+			}
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if !tt.wantAllowed && (resp.Result == nil || resp.Result.Code != http.StatusUnprocessableEntity ||
+				!strings.Contains(resp.Result.Message, tt.wantMsg)) {
+				t.Errorf("result = %+v, want code %d and message containing %q", resp.Result, http.StatusUnprocessableEntity, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestValidateClaimRequest(t *testing.T) {
+
+	c := fake.NewSimpleClientset(
+		&storageV1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "s3"},
+			Provisioner: provisionerName,
+			Parameters:  map[string]string{scAllowedNamespaces: "apps"},
+		},
+		&storageV1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "other"},
+			Provisioner: "example.com/bucket",
+		},
+	)
+	claim := func(ns, sc, name string) *v1alpha1.ObjectBucketClaim {
+		return &v1alpha1.ObjectBucketClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "claim"},
+			Spec:       v1alpha1.ObjectBucketClaimSpec{StorageClassName: sc, BucketName: name},
+		}
+	}
+	deleting := claim("dev", "s3", "Bkt")
+	deleting.DeletionTimestamp = &metav1.Time{}
+	finalized := claim("dev", "s3", "Bkt")
+	finalized.Finalizers = []string{"objectbucket.io/finalizer"}
+
+	tests := []struct {
+		name    string
+		req     *admissionv1beta1.AdmissionRequest
+		wantErr string
+	}{
+		{"valid", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("apps", "s3", "bkt"), nil), ""},
+		{"namespace from the request", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("", "s3", "bkt"), nil), ""},
+		{"namespace not allowed", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("dev", "s3", "bkt"), nil), `namespace "dev"`},
+		{"invalid name", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("apps", "s3", "Bkt"), nil), "lowercase"},
+		{"storage class of another provisioner", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("dev", "other", "Bkt"), nil), ""},
+		{"storage class not found", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("dev", "missing", "Bkt"), nil), ""},
+		{"without storage class", admissionRequest("ObjectBucketClaim", admissionv1beta1.Create, claim("dev", "", "Bkt"), nil), ""},
+		{"being deleted", admissionRequest("ObjectBucketClaim", admissionv1beta1.Update, deleting, claim("dev", "s3", "Bkt")), ""},
+		{"metadata update of an invalid claim", admissionRequest("ObjectBucketClaim", admissionv1beta1.Update, finalized, claim("dev", "s3", "Bkt")), ""},
+		{"update to an invalid name", admissionRequest("ObjectBucketClaim", admissionv1beta1.Update, claim("apps", "s3", "Bkt2"), claim("apps", "s3", "bkt")), "lowercase"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClaimRequest(c, tt.req)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateClaimRequest() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateClaimRequest() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}